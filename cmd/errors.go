@@ -0,0 +1,30 @@
+package cmd
+
+import "github.com/tesh254/stick/internal/vbranch"
+
+// exit codes stick returns, so scripts can tell failures apart
+const (
+	exitError          = 1
+	exitNotGitRepo     = 3
+	exitBranchNotFound = 4
+	exitHunkNotFound   = 5
+	exitConflict       = 6
+	exitDirtyState     = 7
+)
+
+// exitCode maps an error returned by a command to stick's exit code
+func exitCode(err error) int {
+	switch vbranch.ErrorKind(err) {
+	case "not_a_git_repository":
+		return exitNotGitRepo
+	case "branch_not_found":
+		return exitBranchNotFound
+	case "hunk_not_found":
+		return exitHunkNotFound
+	case "conflict":
+		return exitConflict
+	case "dirty_state":
+		return exitDirtyState
+	}
+	return exitError
+}
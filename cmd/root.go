@@ -19,6 +19,11 @@ var rootCmd = &cobra.Command{
 	Short:   "stick is a lightweight CLI tool for managing multiple virtual branches in Git, enabling seamless work on different features without branch switching.",
 	Version: constants.VERSION(),
 	Aliases: []string{"stk"},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		jsonFlag, _ := cmd.Flags().GetBool("json")
+		format, _ := cmd.Flags().GetString("format")
+		return vbranch.SetOutputFormat(jsonFlag, format)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		vbranch.InitializeState()
 		if versionFlag, _ := cmd.Flags().GetBool("version"); versionFlag {
@@ -43,13 +48,12 @@ var versionCmd = &cobra.Command{
 This command displays version information extracted automatically from 
 the Go build system, including Git commit, build date, and more.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		jsonFlag, _ := cmd.Flags().GetBool("json")
 		shortFlag, _ := cmd.Flags().GetBool("short")
 		commitFlag, _ := cmd.Flags().GetBool("commit")
 
 		switch {
-		case jsonFlag:
-			fmt.Println(version.GetJSONVersion())
+		case vbranch.Structured():
+			vbranch.PrintDocument(cmd.Name(), version.GetBuildInfo())
 		case shortFlag:
 			fmt.Println(version.GetShortVersion())
 		case commitFlag:
@@ -73,6 +77,10 @@ var buildInfoCmd = &cobra.Command{
 	Long:  `show comprehensive build information including module details, VCS info, and build settings.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		info := version.GetBuildInfo()
+		if vbranch.Structured() {
+			vbranch.PrintDocument(cmd.Name(), info)
+			return
+		}
 
 		fmt.Printf("Build Information:\n")
 		fmt.Printf("==================\n")
@@ -103,10 +111,11 @@ var buildInfoCmd = &cobra.Command{
 	},
 }
 
+// Execute runs the root command. fang prints any error; the exit code tells
+// scripts what kind of error it was.
 func Execute() {
 	if err := fang.Execute(context.Background(), rootCmd, fang.WithVersion(constants.VERSION())); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -115,9 +124,10 @@ func init() {
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 	// Root command flags
 	rootCmd.Flags().BoolP("version", "v", false, "Print detailed version information")
+	rootCmd.PersistentFlags().Bool("json", false, "Print output as a versioned JSON document")
+	rootCmd.PersistentFlags().String("format", "", "Render the JSON document with a Go template")
 
 	// Version command flags
-	versionCmd.Flags().Bool("json", false, "Output version information in JSON format")
 	versionCmd.Flags().BoolP("short", "s", false, "Output short version only")
 	versionCmd.Flags().BoolP("commit", "c", false, "Output version with commit hash")
 	rootCmd.AddCommand(buildInfoCmd)
@@ -128,9 +138,17 @@ func init() {
 	rootCmd.AddCommand(addCmd())
 	rootCmd.AddCommand(moveCmd())
 	rootCmd.AddCommand(pushCmd())
+	rootCmd.AddCommand(stageCmd())
 	rootCmd.AddCommand(applyCmd())
 	rootCmd.AddCommand(unapplyCmd())
 	rootCmd.AddCommand(syncCmd())
+	rootCmd.AddCommand(rebaseCmd())
+	rootCmd.AddCommand(uiCmd())
+	rootCmd.AddCommand(diffCmd())
+	rootCmd.AddCommand(undoCmd())
+	rootCmd.AddCommand(redoCmd())
+	rootCmd.AddCommand(oplogCmd())
+	rootCmd.AddCommand(gcCmd())
 }
 
 func initConfig() {
@@ -2,18 +2,78 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/tesh254/stick/internal/vbranch"
 )
 
+// commandName is the command line of cmd without the program name
+func commandName(cmd *cobra.Command) string {
+	return strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+}
+
+// withStateLock holds the state lock for the whole run of a command, so its
+// load-modify-save cycle cannot interleave with another stick process. The
+// --json or --format document is printed once the command is done, and the
+// command's error is returned for Execute to turn into an exit code.
+func withStateLock(run func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) error {
+	return withOutput(func(cmd *cobra.Command, args []string) error {
+		return lockAndRun(run, cmd, args)
+	})
+}
+
+// withOutput reports a command's error and flushes its structured output,
+// for commands that take the state lock themselves
+func withOutput(run func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		err := run(cmd, args)
+		if err != nil {
+			vbranch.Fail(err)
+		}
+		if flushErr := vbranch.FlushOutput(commandName(cmd)); flushErr != nil && err == nil {
+			err = flushErr
+		}
+		return err
+	}
+}
+
+// lockAndRun runs a command while holding the state lock
+func lockAndRun(run func(cmd *cobra.Command, args []string) error, cmd *cobra.Command, args []string) error {
+	unlock, err := vbranch.LockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return run(cmd, args)
+}
+
+// withOperation runs a mutating command under the state lock and records
+// it in the operation log so it can be undone. A command that fails part
+// way is still recorded, since it may have changed files or state.
+func withOperation(run func(cmd *cobra.Command, args []string) error) func(cmd *cobra.Command, args []string) error {
+	return withStateLock(func(cmd *cobra.Command, args []string) error {
+		command := strings.Join(append([]string{commandName(cmd)}, args...), " ")
+		op, err := vbranch.BeginOperation(command)
+		if err != nil {
+			return err
+		}
+		err = run(cmd, args)
+		if finishErr := op.Finish(); finishErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not record operation: %v\n", finishErr)
+		}
+		return err
+	})
+}
+
 func initCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "init",
 		Short: "initialise stick in current directory",
-		Run: func(cmd *cobra.Command, args []string) {
-			vbranch.Init()
-		},
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			return vbranch.Init()
+		}),
 	}
 }
 
@@ -27,37 +87,83 @@ func branchCmd() *cobra.Command {
 	branchCmd.AddCommand(&cobra.Command{
 		Use:   "list",
 		Short: "list all virtual branches",
-		Run: func(cmd *cobra.Command, args []string) {
-			vbranch.ListBranches()
-		},
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			return vbranch.ListBranches()
+		}),
 	})
 
-	branchCmd.AddCommand(&cobra.Command{
+	createCmd := &cobra.Command{
 		Use:   "create [name]",
 		Short: "create a new virtual branch",
-		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) == 0 {
-				fmt.Println("please provide a branch name")
-				return
-			}
+		Args:  cobra.ExactArgs(1),
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
 			name := args[0]
-			vbranch.CreateBranch(name)
-		},
-	})
+			var from *string
+			if cmd.Flags().Changed("from") {
+				f, _ := cmd.Flags().GetString("from")
+				from = &f
+			}
+			yes, _ := cmd.Flags().GetBool("yes")
+			return vbranch.CreateBranch(name, from, yes)
+		}),
+	}
+	createCmd.Flags().String("from", "", "Base the branch on a remote branch (<remote>/<branch>, or a remote to pick from)")
+	createCmd.Flags().BoolP("yes", "y", false, "Use the remote's default branch instead of prompting")
+	branchCmd.AddCommand(createCmd)
 
 	branchCmd.AddCommand(&cobra.Command{
 		Use:   "switch [name]",
 		Short: "switch to a virtual branches",
-		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) == 0 {
-				fmt.Println("please provide a virtual branch name")
-				return
-			}
+		Args:  cobra.ExactArgs(1),
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
 			name := args[0]
-			vbranch.SwitchBranch(name, args)
-		},
+			return vbranch.SwitchBranch(name, args)
+		}),
 	})
 
+	deleteCmd := &cobra.Command{
+		Use:   "delete [name]",
+		Short: "delete a virtual branch",
+		Args:  cobra.ExactArgs(1),
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+			moveTo, _ := cmd.Flags().GetString("move-to")
+			return vbranch.DeleteBranch(args[0], force, moveTo)
+		}),
+	}
+	deleteCmd.Flags().BoolP("force", "f", false, "Delete even if the branch has unpushed hunks")
+	deleteCmd.Flags().String("move-to", "", "Move the branch's hunks to another virtual branch before deleting")
+	branchCmd.AddCommand(deleteCmd)
+
+	branchCmd.AddCommand(&cobra.Command{
+		Use:   "rename [old-name] [new-name]",
+		Short: "rename a virtual branch",
+		Args:  cobra.ExactArgs(2),
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			return vbranch.RenameBranch(args[0], args[1])
+		}),
+	})
+
+	describeCmd := &cobra.Command{
+		Use:   "describe [name]",
+		Short: "edit the description used as a virtual branch's commit message",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			var branchName *string
+			if len(args) == 1 {
+				branchName = &args[0]
+			}
+			var message *string
+			if cmd.Flags().Changed("message") {
+				m, _ := cmd.Flags().GetString("message")
+				message = &m
+			}
+			return vbranch.DescribeBranch(branchName, message)
+		}),
+	}
+	describeCmd.Flags().StringP("message", "m", "", "Set the description without opening $EDITOR")
+	branchCmd.AddCommand(describeCmd)
+
 	return branchCmd
 }
 
@@ -66,9 +172,9 @@ func statusCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "status",
 		Short: "show status of virtual branches and changes",
-		Run: func(cmd *cobra.Command, args []string) {
-			vbranch.Status()
-		},
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			return vbranch.Status()
+		}),
 	}
 }
 
@@ -77,11 +183,14 @@ func addCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "add [file...]",
 		Short: "add file changes to current virtual branch",
-		Run: func(cmd *cobra.Command, args []string) {
-			vbranch.AddFile(cmd, args)
-		},
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			return vbranch.AddFile(cmd, args)
+		}),
 	}
 	cmd.Flags().BoolP("all", "A", false, "Add all changes")
+	cmd.Flags().BoolP("patch", "p", false, "Pick hunks interactively and assign each to a branch")
+	cmd.Flags().Bool("staged", false, "Add changes exactly as they are staged in the Git index, leaving unstaged edits out")
+	cmd.Flags().IntP("find-renames", "M", vbranch.DefaultRenameThreshold, "Similarity percentage at which a new file counts as a rename or copy; 0 turns detection off")
 	return cmd
 }
 
@@ -91,13 +200,9 @@ func moveCmd() *cobra.Command {
 		Use:   "move [hunk-id] [target-branch]",
 		Short: "Move a change hunk to another virtual branch",
 		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) != 2 {
-				fmt.Println("please provide a hunk id and a target branch")
-				return
-			}
-			vbranch.MoveHunkToTargetBranch(args[0], args[1])
-		},
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			return vbranch.MoveHunkToTargetBranch(args[0], args[1])
+		}),
 	}
 }
 
@@ -107,15 +212,31 @@ func pushCmd() *cobra.Command {
 		Use:   "push [branch-name]",
 		Short: "push virtual branch to remote as a Git branch",
 		Args:  cobra.MaximumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
 			var branchName *string
 			if len(args) == 0 {
 				branchName = nil
 			} else {
 				branchName = &args[0]
 			}
-			vbranch.PushBranchToRemoteAsGitBranch(branchName)
-		},
+			return vbranch.PushBranchToRemoteAsGitBranch(branchName)
+		}),
+	}
+}
+
+func stageCmd() *cobra.Command {
+	vbranch.EnsureStateInitialized()
+	return &cobra.Command{
+		Use:   "stage [branch-name]",
+		Short: "load virtual branch changes into the Git index",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			var branchName *string
+			if len(args) == 1 {
+				branchName = &args[0]
+			}
+			return vbranch.StageBranch(branchName)
+		}),
 	}
 }
 
@@ -125,15 +246,15 @@ func applyCmd() *cobra.Command {
 		Use:   "apply [branch-name]",
 		Short: "apply virtual branch changes to working directory",
 		Args:  cobra.MaximumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
 			var branchName *string
 			if len(args) == 0 {
 				branchName = nil
 			} else {
 				branchName = &args[0]
 			}
-			vbranch.ApplyVBranchChangesToWorkingDir(branchName)
-		},
+			return vbranch.ApplyVBranchChangesToWorkingDir(branchName)
+		}),
 	}
 }
 
@@ -143,15 +264,15 @@ func unapplyCmd() *cobra.Command {
 		Use:   "unapply [branch-name]",
 		Short: "remove virtual branch changes from working directory",
 		Args:  cobra.MaximumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
 			var branchName *string
 			if len(args) == 0 {
 				branchName = nil
 			} else {
 				branchName = &args[0]
 			}
-			vbranch.UnapplyVBranchChangesToWorkingDir(branchName)
-		},
+			return vbranch.UnapplyVBranchChangesToWorkingDir(branchName)
+		}),
 	}
 }
 
@@ -160,8 +281,128 @@ func syncCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "sync",
 		Short: "sync virtual branches with Git repository state",
-		Run: func(cmd *cobra.Command, args []string) {
-			vbranch.SyncBranchesWithGitRepoState()
-		},
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			return vbranch.SyncBranchesWithGitRepoState()
+		}),
 	}
 }
+
+func rebaseCmd() *cobra.Command {
+	vbranch.EnsureStateInitialized()
+	cmd := &cobra.Command{
+		Use:   "rebase [branch-name...]",
+		Short: "carry virtual branches onto a new base commit",
+		RunE: withOperation(func(cmd *cobra.Command, args []string) error {
+			onto, _ := cmd.Flags().GetString("onto")
+			return vbranch.RebaseBranches(onto, args)
+		}),
+	}
+	cmd.Flags().String("onto", "HEAD", "commit to rebase the virtual branches onto")
+	return cmd
+}
+
+func uiCmd() *cobra.Command {
+	vbranch.EnsureStateInitialized()
+	return &cobra.Command{
+		Use:   "ui",
+		Short: "arrange hunks across virtual branches in a full-screen interface",
+		Args:  cobra.NoArgs,
+		RunE: withOutput(func(cmd *cobra.Command, args []string) error {
+			return vbranch.RunUI()
+		}),
+	}
+}
+
+func diffCmd() *cobra.Command {
+	vbranch.EnsureStateInitialized()
+	cmd := &cobra.Command{
+		Use:   "diff [branch-name]",
+		Short: "show a virtual branch as a unified diff against its base",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			var branchName *string
+			if len(args) == 0 {
+				branchName = nil
+			} else {
+				branchName = &args[0]
+			}
+			stat, _ := cmd.Flags().GetBool("stat")
+			nameOnly, _ := cmd.Flags().GetBool("name-only")
+			patch, _ := cmd.Flags().GetBool("patch")
+			return vbranch.ShowDiff(branchName, stat, nameOnly, patch)
+		}),
+	}
+	cmd.Flags().Bool("stat", false, "Show a diffstat instead of the patch")
+	cmd.Flags().Bool("name-only", false, "Show only the names of changed files")
+	cmd.Flags().Bool("patch", false, "Print a plain patch suitable for git apply")
+	return cmd
+}
+
+func undoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "undo",
+		Short: "undo the last recorded stick operation",
+		Args:  cobra.NoArgs,
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+			return vbranch.Undo(force)
+		}),
+	}
+	cmd.Flags().BoolP("force", "f", false, "Overwrite files edited since the operation")
+	return cmd
+}
+
+func redoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "redo",
+		Short: "redo the last undone stick operation",
+		Args:  cobra.NoArgs,
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+			return vbranch.Redo(force)
+		}),
+	}
+	cmd.Flags().BoolP("force", "f", false, "Overwrite files edited since the operation")
+	return cmd
+}
+
+func oplogCmd() *cobra.Command {
+	oplogCmd := &cobra.Command{
+		Use:   "oplog",
+		Short: "show the log of stick operations",
+		Args:  cobra.NoArgs,
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			return vbranch.ShowOplog()
+		}),
+	}
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore [operation-id]",
+		Short: "restore state and files to just after an operation",
+		Args:  cobra.ExactArgs(1),
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+			return vbranch.RestoreOperation(args[0], force)
+		}),
+	}
+	restoreCmd.Flags().BoolP("force", "f", false, "Overwrite files edited since the current operation")
+	oplogCmd.AddCommand(restoreCmd)
+
+	return oplogCmd
+}
+
+func gcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "forget old operations and release stored contents nothing refers to",
+		Args:  cobra.NoArgs,
+		RunE: withStateLock(func(cmd *cobra.Command, args []string) error {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			expire, _ := cmd.Flags().GetDuration("expire")
+			return vbranch.GC(dryRun, expire)
+		}),
+	}
+	cmd.Flags().BoolP("dry-run", "n", false, "Report what would be released without changing anything")
+	cmd.Flags().Duration("expire", vbranch.DefaultOplogExpiry, "Forget operations older than this; they can no longer be undone")
+	return cmd
+}
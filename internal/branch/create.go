@@ -3,114 +3,156 @@ package branch
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/manifoldco/promptui"
-	"github.com/tesh254/stick/internal/metadata"
 )
 
-func CreateVirtualBranch(branchName *string, remoteName *string) {
-	var virtualBranchName string = "portal"
-	var baseBranch string
+// Base is the remote branch a new virtual branch starts from
+type Base struct {
+	Remote    string // remote the base was fetched from, e.g. "origin"
+	Branch    string // branch on that remote, e.g. "main"
+	Commit    string // commit the remote branch pointed at after fetching
+	GitBranch string // local branch created for the virtual branch, "stick/<name>"
+}
+
+// Options controls how CreateVirtualBranch talks to the user
+type Options struct {
+	Yes      bool                             // use the remote's default branch instead of asking
+	NoPrompt bool                             // asking is not possible, e.g. while stdout carries a document
+	Say      func(format string, args ...any) // reports progress
+}
+
+// Ref returns the base as a remote-tracking name such as "origin/main"
+func (b *Base) Ref() string {
+	return b.Remote + "/" + b.Branch
+}
 
+// CreateVirtualBranch prepares the Git side of a virtual branch based on a
+// remote branch. from names "<remote>/<branch>" or just a remote, in which
+// case the branch is picked interactively, or the remote's default branch
+// is used when opts.Yes is set. A local "stick/<name>" branch is created at
+// the chosen base.
+func CreateVirtualBranch(name string, from string, opts Options) (*Base, error) {
 	// check if we're in a git repository
 	if err := checkGitRepository(); err != nil {
-		fmt.Println("Error:", err)
-		return
+		return nil, err
 	}
 
 	// determine remote name
-	var rm string = "origin"
-	if remoteName != nil {
-		rm = *remoteName
+	rm, baseBranch, err := splitRemoteRef(from)
+	if err != nil {
+		return nil, err
 	}
 
 	// check if remote exists
 	if err := checkRemoteExists(rm); err != nil {
-		var remoteMessage string = ""
-		if remoteName == nil {
-			remoteMessage = "\nplease provide a remote name if it's not origin"
+		if from == "" {
+			return nil, fmt.Errorf("%v\nplease provide a remote name if it's not origin", err)
 		}
-		fmt.Println("error:", err, remoteMessage)
-		return
+		return nil, err
 	}
 
 	// fetch from remote
-	fmt.Printf("fetching from remote '%s'...\n", rm)
+	opts.Say("fetching from remote '%s'...", rm)
 	if err := fetchRemote(rm); err != nil {
-		fmt.Println("error:", err)
-		return
-	}
-
-	// get default branch
-	defaultBranch, err := getDefaultBranch(rm)
-	if err != nil {
-		fmt.Println("error:", err)
-		return
+		return nil, err
 	}
 
 	// get all remote branches
 	branchList, err := getRemoteBranches(rm)
 	if err != nil {
-		fmt.Println("error:", err)
-		return
+		return nil, err
 	}
 
 	if len(branchList) == 0 {
-		fmt.Println("no remote branches found")
-		return
+		return nil, fmt.Errorf("no remote branches found")
 	}
 
 	// determine base branch
-	if branchName != nil {
-		baseBranch = *branchName
-	} else {
-		// prompt user to select branch
-		prompt := promptui.Select{
-			Label: fmt.Sprintf("select base branch for virtual branch (default: %s)", defaultBranch),
-			Items: branchList,
+	if baseBranch == "" {
+		defaultBranch, err := getDefaultBranch(rm)
+		if err != nil {
+			return nil, err
 		}
-		_, selectedBranch, promptError := prompt.Run()
-		if promptError != nil {
-			fmt.Println("prompt cancelled or failed:", promptError)
-			return
+		if opts.Yes {
+			baseBranch = defaultBranch
+		} else if opts.NoPrompt {
+			return nil, fmt.Errorf("no base branch given; name one as %s/<branch> or pass --yes to use %s", rm, defaultBranch)
+		} else {
+			// prompt user to select branch, starting on the default
+			cursor := 0
+			for i, b := range branchList {
+				if b == defaultBranch {
+					cursor = i
+				}
+			}
+			prompt := promptui.Select{
+				Label:     fmt.Sprintf("select base branch for virtual branch (default: %s)", defaultBranch),
+				Items:     branchList,
+				CursorPos: cursor,
+			}
+			_, selectedBranch, promptError := prompt.Run()
+			if promptError != nil {
+				return nil, fmt.Errorf("prompt cancelled or failed: %v", promptError)
+			}
+			baseBranch = selectedBranch
 		}
-		baseBranch = selectedBranch
-		fmt.Printf("selected base branch: %s\n", baseBranch)
+		opts.Say("selected base branch: %s", baseBranch)
 	}
 
 	// validate chosen branch exists remotely
 	if !remoteBranchExists(rm, baseBranch) {
-		fmt.Printf("base branch '%s' not found in remote. available branches: %v\n", baseBranch, branchList)
-		return
+		return nil, fmt.Errorf("base branch '%s' not found in remote. available branches: %v", baseBranch, branchList)
 	}
 
-	// load metadata
-	md := metadata.LoadMetadata()
-	if _, exists := md.VirtualBranches[virtualBranchName]; exists {
-		fmt.Println("virtual branch already exists.")
-		return
+	commit, err := executeGitCommand("rev-parse", "--verify", fmt.Sprintf("refs/remotes/%s/%s^{commit}", rm, baseBranch))
+	if err != nil {
+		return nil, err
 	}
 
 	// create a new Git branch (e.g., "stick/<virtual_branch_name>")
-	gitBranchName := "stick/" + virtualBranchName
+	gitBranchName := "stick/" + name
 
 	// check if the branch already exists
 	if branchExists(gitBranchName) {
-		fmt.Printf("git branch '%s' already exists\n", gitBranchName)
-		return
+		return nil, fmt.Errorf("git branch '%s' already exists", gitBranchName)
 	}
 
 	// create the local branch from the remote branch
 	if err := createLocalBranch(gitBranchName, rm, baseBranch); err != nil {
-		fmt.Println("error:", err)
-		return
+		return nil, err
 	}
 
-	// update metadata
-	md.VirtualBranches[virtualBranchName] = metadata.VirtualBranch{
+	return &Base{
+		Remote:    rm,
+		Branch:    baseBranch,
+		Commit:    commit,
 		GitBranch: gitBranchName,
-		Files:     []string{},
+	}, nil
+}
+
+// splitRemoteRef splits from into a remote and a branch on it. The longest
+// configured remote that prefixes from wins, since branch names may contain
+// slashes. An empty from means origin with no branch chosen yet.
+func splitRemoteRef(from string) (string, string, error) {
+	if from == "" {
+		return "origin", "", nil
+	}
+
+	output, err := executeGitCommand("remote")
+	if err != nil {
+		return "", "", err
+	}
+	remote := ""
+	for _, rm := range strings.Fields(output) {
+		if (from == rm || strings.HasPrefix(from, rm+"/")) && len(rm) > len(remote) {
+			remote = rm
+		}
+	}
+	if remote == "" {
+		name, _, _ := strings.Cut(from, "/")
+		return "", "", fmt.Errorf("remote '%s' not found", name)
 	}
-	metadata.SaveMetadata(md)
-	fmt.Printf("virtual branch '%s' created successfully (git branch: %s)\n", virtualBranchName, gitBranchName)
+	return remote, strings.TrimPrefix(strings.TrimPrefix(from, remote), "/"), nil
 }
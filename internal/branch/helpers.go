@@ -65,11 +65,11 @@ func getDefaultBranch(remoteName string) (string, error) {
 	}
 
 	// Extract branch name from refs/remotes/origin/main
-	parts := strings.Split(output, "/")
-	if len(parts) < 1 {
+	prefix := fmt.Sprintf("refs/remotes/%s/", remoteName)
+	if !strings.HasPrefix(output, prefix) {
 		return "", fmt.Errorf("unexpected format for default branch: %s", output)
 	}
-	return parts[len(parts)-1], nil
+	return strings.TrimPrefix(output, prefix), nil
 }
 
 // getRemoteBranches gets all remote branches for the specified remote
@@ -13,8 +13,16 @@ const ASCII = `
 +-+-+-+-+-+--+
 `
 
-const STICK_DIR = ".stick"
-const STATE_FILE = ".stick/state.json"
+// STICK_DIR is the directory inside the Git common directory that holds stick's files
+const STICK_DIR = "stick"
+const STATE_FILE = "state.json"
+const METADATA_FILE = "metadata.json"
+const JOURNAL_FILE = "state.journal"
+const OPLOG_FILE = "oplog.jsonl"
+const OPLOG_HEAD_FILE = "oplog.head"
+
+// LEGACY_STICK_DIR is where older versions kept their files, inside the working tree
+const LEGACY_STICK_DIR = ".stick"
 
 // VERSION returns the current version from build info
 func VERSION() string {
@@ -0,0 +1,160 @@
+package diff
+
+import "strings"
+
+// Op identifies what a diff line does to the old version
+type Op byte
+
+const (
+	Equal  Op = ' '
+	Delete Op = '-'
+	Insert Op = '+'
+)
+
+// maxEditCost bounds the Myers search; larger rewrites are emitted as a
+// single replacement instead of a minimal script
+const maxEditCost = 4096
+
+// Line is a single line of an edit script. Text keeps its trailing newline,
+// so the last line of a file without one is represented exactly.
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// SplitLines splits s into lines, each keeping its "\n" terminator
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Lines returns the line-level edit script that turns a into b
+func Lines(a, b []string) []Line {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	script := make([]Line, 0, len(a)+len(b))
+	for _, text := range a[:prefix] {
+		script = append(script, Line{Op: Equal, Text: text})
+	}
+	script = append(script, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		script = append(script, Line{Op: Equal, Text: text})
+	}
+	return script
+}
+
+// replace emits a as deleted and b as inserted
+func replace(a, b []string) []Line {
+	script := make([]Line, 0, len(a)+len(b))
+	for _, text := range a {
+		script = append(script, Line{Op: Delete, Text: text})
+	}
+	for _, text := range b {
+		script = append(script, Line{Op: Insert, Text: text})
+	}
+	return script
+}
+
+// frontier is the furthest x reached on each diagonal k in [lo, lo+len(x))
+type frontier struct {
+	lo int
+	x  []int
+}
+
+func (f frontier) at(k int) int {
+	return f.x[k-f.lo]
+}
+
+// myers implements Eugene Myers' O(ND) shortest edit script search
+func myers(a, b []string) []Line {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replace(a, b)
+	}
+
+	maxD := n + m
+	if maxD > maxEditCost {
+		maxD = maxEditCost
+	}
+	offset := maxD + 1
+	v := make([]int, 2*offset+1)
+	var trace []frontier
+
+	for d := 0; d <= maxD; d++ {
+		snapshot := frontier{lo: -d - 1, x: make([]int, 2*d+3)}
+		copy(snapshot.x, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+
+	return replace(a, b)
+}
+
+func backtrack(a, b []string, trace []frontier) []Line {
+	x, y := len(a), len(b)
+	var reversed []Line
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v.at(k-1) < v.at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v.at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Line{Op: Equal, Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, Line{Op: Insert, Text: b[y-1]})
+			} else {
+				reversed = append(reversed, Line{Op: Delete, Text: a[x-1]})
+			}
+			x, y = prevX, prevY
+		}
+	}
+
+	script := make([]Line, len(reversed))
+	for i, line := range reversed {
+		script[len(reversed)-1-i] = line
+	}
+	return script
+}
@@ -0,0 +1,100 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pairs are old and new versions of a file exercised by the tests
+var pairs = []struct {
+	name string
+	a, b string
+}{
+	{"identical", "a\nb\nc\n", "a\nb\nc\n"},
+	{"from empty", "", "a\nb\n"},
+	{"to empty", "a\nb\n", ""},
+	{"insert at start", "b\nc\n", "a\nb\nc\n"},
+	{"insert at end", "a\nb\n", "a\nb\nc\n"},
+	{"insert in middle", "a\nc\n", "a\nb\nc\n"},
+	{"delete in middle", "a\nb\nc\n", "a\nc\n"},
+	{"replace line", "a\nb\nc\n", "a\nB\nc\n"},
+	{"add newline at end of file", "a\nb", "a\nb\n"},
+	{"remove newline at end of file", "a\nb\n", "a\nb"},
+	{"change last line without newline", "a\nb", "a\nc"},
+	{"repeated lines", "x\nx\nx\ny\nx\n", "x\ny\nx\nx\ny\n"},
+	{"blank lines", "a\n\n\nb\n", "a\n\nb\n\n"},
+	{"separate changes", numbered(1, 30, map[int]string{3: "three", 25: "twenty-five"}), numbered(1, 30, nil)},
+	{"adjacent changes", numbered(1, 12, map[int]string{4: "four", 8: "eight"}), numbered(1, 12, map[int]string{6: "six"})},
+	{"interleaved inserts and deletes", "a\nb\nc\nd\ne\nf\n", "a\nX\nc\nY\nZ\nf\ng\n"},
+}
+
+// numbered returns lines first..last, one number per line, with the given
+// lines replaced
+func numbered(first, last int, replaced map[int]string) string {
+	var sb strings.Builder
+	for i := first; i <= last; i++ {
+		if text, ok := replaced[i]; ok {
+			sb.WriteString(text + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "%d\n", i)
+	}
+	return sb.String()
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"\n\n", []string{"\n", "\n"}},
+	}
+	for _, tt := range tests {
+		if got := SplitLines(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	for _, tt := range pairs {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := SplitLines(tt.a), SplitLines(tt.b)
+			var old, new []string
+			for _, line := range Lines(a, b) {
+				if line.Op != Insert {
+					old = append(old, line.Text)
+				}
+				if line.Op != Delete {
+					new = append(new, line.Text)
+				}
+			}
+			if strings.Join(old, "") != tt.a {
+				t.Errorf("old side of script = %q, want %q", strings.Join(old, ""), tt.a)
+			}
+			if strings.Join(new, "") != tt.b {
+				t.Errorf("new side of script = %q, want %q", strings.Join(new, ""), tt.b)
+			}
+		})
+	}
+}
+
+func TestLinesLargeRewrite(t *testing.T) {
+	// past maxEditCost the script falls back to a replacement, which must
+	// still describe both versions
+	var a, b []string
+	for i := 0; i < 3000; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	hunks := Hunks(a, b, DefaultContext)
+	if got, failed := Apply(a, hunks); len(failed) > 0 || !reflect.DeepEqual(got, b) {
+		t.Errorf("Apply of a large rewrite failed: %v", failed)
+	}
+}
@@ -0,0 +1,243 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultContext is the number of unchanged lines kept around each change
+const DefaultContext = 3
+
+const noNewlineMarker = "\\ No newline at end of file"
+
+// Hunk is a unified-diff hunk. Start lines follow the unified format: they
+// are 1-based, and when a side has no lines they name the line before it.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []Line
+}
+
+// Hunks computes the unified-diff hunks between a and b
+func Hunks(a, b []string, context int) []Hunk {
+	return Group(Lines(a, b), context)
+}
+
+// Group splits an edit script into hunks, merging changes whose
+// surrounding context would overlap
+func Group(script []Line, context int) []Hunk {
+	var changes []int
+	for i, line := range script {
+		if line.Op != Equal {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// old/new line counts before each script index
+	oldBefore := make([]int, len(script)+1)
+	newBefore := make([]int, len(script)+1)
+	for i, line := range script {
+		oldBefore[i+1] = oldBefore[i]
+		newBefore[i+1] = newBefore[i]
+		if line.Op != Insert {
+			oldBefore[i+1]++
+		}
+		if line.Op != Delete {
+			newBefore[i+1]++
+		}
+	}
+
+	var hunks []Hunk
+	first := changes[0]
+	last := changes[0]
+	flush := func() {
+		start := max(first-context, 0)
+		end := min(last+context+1, len(script))
+		h := Hunk{
+			OldLines: oldBefore[end] - oldBefore[start],
+			NewLines: newBefore[end] - newBefore[start],
+			Lines:    append([]Line(nil), script[start:end]...),
+		}
+		h.OldStart = oldBefore[start]
+		if h.OldLines > 0 {
+			h.OldStart++
+		}
+		h.NewStart = newBefore[start]
+		if h.NewLines > 0 {
+			h.NewStart++
+		}
+		hunks = append(hunks, h)
+	}
+
+	for _, i := range changes[1:] {
+		if i-last-1 > 2*context {
+			flush()
+			first = i
+		}
+		last = i
+	}
+	flush()
+
+	return hunks
+}
+
+// Split breaks the hunk into one hunk per run of changes. The unchanged
+// lines between two runs are shared out so the pieces do not overlap and
+// can still be applied together. A piece that only inserts lines is given
+// at least one unchanged line, since it would have nothing to be placed by
+// otherwise; where there is none to give, it is joined to the piece before
+// it. A hunk with a single run is returned as is.
+func (h Hunk) Split() []Hunk {
+	var runs [][]Line
+	oldLine, newLine := h.OldStart, h.NewStart
+	if h.OldLines == 0 {
+		oldLine++
+	}
+	if h.NewLines == 0 {
+		newLine++
+	}
+
+	start := 0
+	for start < len(h.Lines) {
+		// the piece runs through its changes and the first half of the
+		// unchanged lines that follow them
+		end := start
+		for end < len(h.Lines) && h.Lines[end].Op == Equal {
+			end++
+		}
+		for end < len(h.Lines) && h.Lines[end].Op != Equal {
+			end++
+		}
+		gap := end
+		for gap < len(h.Lines) && h.Lines[gap].Op == Equal {
+			gap++
+		}
+		if gap < len(h.Lines) {
+			share := (gap - end) / 2
+			if share == 0 && gap > end && !anchored(h.Lines[start:end]) {
+				share = 1
+			}
+			end += share
+		} else {
+			end = gap
+		}
+
+		run := h.Lines[start:end]
+		if len(runs) > 0 && !anchored(run) {
+			runs[len(runs)-1] = append(runs[len(runs)-1], run...)
+		} else {
+			runs = append(runs, append([]Line(nil), run...))
+		}
+		start = end
+	}
+
+	var pieces []Hunk
+	for _, run := range runs {
+		piece := Hunk{Lines: run}
+		for _, line := range piece.Lines {
+			if line.Op != Insert {
+				piece.OldLines++
+			}
+			if line.Op != Delete {
+				piece.NewLines++
+			}
+		}
+		piece.OldStart, piece.NewStart = oldLine, newLine
+		oldLine += piece.OldLines
+		newLine += piece.NewLines
+		if piece.OldLines == 0 {
+			piece.OldStart--
+		}
+		if piece.NewLines == 0 {
+			piece.NewStart--
+		}
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+// anchored reports whether lines have a preimage to be placed by: a line
+// that is kept or removed rather than only added
+func anchored(lines []Line) bool {
+	for _, line := range lines {
+		if line.Op != Insert {
+			return true
+		}
+	}
+	return false
+}
+
+// Header returns the "@@ -a,b +c,d @@" line for the hunk
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", formatRange(h.OldStart, h.OldLines), formatRange(h.NewStart, h.NewLines))
+}
+
+func formatRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// Body renders the hunk lines in unified format, one prefixed line per
+// entry, marking lines that have no trailing newline
+func (h Hunk) Body() string {
+	var sb strings.Builder
+	for _, line := range h.Lines {
+		sb.WriteByte(byte(line.Op))
+		sb.WriteString(strings.TrimSuffix(line.Text, "\n"))
+		sb.WriteByte('\n')
+		if !strings.HasSuffix(line.Text, "\n") {
+			sb.WriteString(noNewlineMarker)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// String renders the hunk header followed by its body
+func (h Hunk) String() string {
+	return h.Header() + "\n" + h.Body()
+}
+
+// Context returns the unchanged lines of the hunk, without prefixes
+func (h Hunk) Context() string {
+	var sb strings.Builder
+	for _, line := range h.Lines {
+		if line.Op == Equal {
+			sb.WriteString(line.Text)
+		}
+	}
+	return sb.String()
+}
+
+// ParseBody parses the output of Body back into lines
+func ParseBody(body string) ([]Line, error) {
+	var lines []Line
+	for _, raw := range SplitLines(body) {
+		text := strings.TrimSuffix(raw, "\n")
+		if text == "" {
+			// some tools strip the space prefix of empty context lines
+			lines = append(lines, Line{Op: Equal, Text: "\n"})
+			continue
+		}
+		switch op := Op(text[0]); op {
+		case Equal, Delete, Insert:
+			lines = append(lines, Line{Op: op, Text: text[1:] + "\n"})
+		case '\\':
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("unexpected %q at start of hunk", text)
+			}
+			last := &lines[len(lines)-1]
+			last.Text = strings.TrimSuffix(last.Text, "\n")
+		default:
+			return nil, fmt.Errorf("invalid hunk line %q", text)
+		}
+	}
+	return lines, nil
+}
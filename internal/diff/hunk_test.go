@@ -0,0 +1,152 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBodyRoundTrip(t *testing.T) {
+	for _, tt := range pairs {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, h := range Hunks(SplitLines(tt.a), SplitLines(tt.b), DefaultContext) {
+				lines, err := ParseBody(h.Body())
+				if err != nil {
+					t.Fatalf("ParseBody: %v", err)
+				}
+				if !reflect.DeepEqual(lines, h.Lines) {
+					t.Errorf("ParseBody(Body()) = %q, want %q", lines, h.Lines)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []Line
+	}{
+		{
+			name: "no newline at end of file",
+			body: " a\n-b\n\\ No newline at end of file\n+b\n",
+			want: []Line{{Equal, "a\n"}, {Delete, "b"}, {Insert, "b\n"}},
+		},
+		{
+			name: "stripped space on empty context line",
+			body: " a\n\n+b\n",
+			want: []Line{{Equal, "a\n"}, {Equal, "\n"}, {Insert, "b\n"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBody(tt.body)
+			if err != nil {
+				t.Fatalf("ParseBody: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBody = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBodyInvalid(t *testing.T) {
+	for _, body := range []string{
+		"\\ No newline at end of file\n",
+		" a\n*b\n",
+	} {
+		if lines, err := ParseBody(body); err == nil {
+			t.Errorf("ParseBody(%q) = %q, want an error", body, lines)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@"},
+		{"", "a\n", "@@ -0,0 +1 @@"},
+		{"a\n", "", "@@ -1 +0,0 @@"},
+	}
+	for _, tt := range tests {
+		hunks := Hunks(SplitLines(tt.a), SplitLines(tt.b), DefaultContext)
+		if len(hunks) != 1 {
+			t.Fatalf("diff of %q and %q gave %d hunks, want 1", tt.a, tt.b, len(hunks))
+		}
+		if got := hunks[0].Header(); got != tt.want {
+			t.Errorf("Header() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	a := SplitLines(numbered(1, 30, nil))
+	tests := []struct {
+		name    string
+		changed map[int]string
+		want    int
+	}{
+		{"no changes", nil, 0},
+		{"one change", map[int]string{10: "ten"}, 1},
+		{"overlapping context is merged", map[int]string{10: "ten", 15: "fifteen"}, 1},
+		{"distant changes stay apart", map[int]string{3: "three", 25: "twenty-five"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks := Hunks(a, SplitLines(numbered(1, 30, tt.changed)), DefaultContext)
+			if len(hunks) != tt.want {
+				t.Errorf("got %d hunks, want %d", len(hunks), tt.want)
+			}
+			for _, h := range hunks {
+				if old := len(h.Preimage()); old != h.OldLines {
+					t.Errorf("hunk %s holds %d old lines", h.Header(), old)
+				}
+				if new := len(h.Postimage()); new != h.NewLines {
+					t.Errorf("hunk %s holds %d new lines", h.Header(), new)
+				}
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tt := range pairs {
+		t.Run(tt.name, func(t *testing.T) {
+			a := SplitLines(tt.a)
+			var pieces []Hunk
+			for _, h := range Hunks(a, SplitLines(tt.b), DefaultContext) {
+				pieces = append(pieces, h.Split()...)
+			}
+			got, failed := Apply(a, pieces)
+			if len(failed) > 0 {
+				t.Fatalf("Apply of split pieces failed %v", failed)
+			}
+			if strings.Join(got, "") != tt.b {
+				t.Errorf("split pieces applied = %q, want %q", strings.Join(got, ""), tt.b)
+			}
+		})
+	}
+}
+
+func TestSplitSeparatesChanges(t *testing.T) {
+	a := SplitLines(numbered(1, 12, nil))
+	b := SplitLines(numbered(1, 12, map[int]string{4: "four", 8: "eight"}))
+	hunks := Hunks(a, b, DefaultContext)
+	if len(hunks) != 1 {
+		t.Fatalf("got %d hunks, want 1", len(hunks))
+	}
+	pieces := hunks[0].Split()
+	if len(pieces) != 2 {
+		t.Fatalf("split into %d pieces, want 2", len(pieces))
+	}
+	// each piece applies on its own
+	for _, piece := range pieces {
+		if _, failed := Apply(a, []Hunk{piece}); len(failed) > 0 {
+			t.Errorf("piece %s does not apply alone", piece.Header())
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package diff
+
+import "sort"
+
+// Conflict is a region of the base version changed differently on both
+// sides of a three-way merge. BaseStart and BaseEnd are 0-based and
+// half-open; an insertion has BaseStart == BaseEnd.
+type Conflict struct {
+	BaseStart int
+	BaseEnd   int
+	Ours      []string
+	Theirs    []string
+}
+
+// region replaces base[start:end] with lines
+type region struct {
+	start, end int
+	lines      []string
+}
+
+// regions converts an edit script into the base ranges it replaces
+func regions(script []Line) []region {
+	var out []region
+	var current *region
+	index := 0
+	for _, line := range script {
+		if line.Op == Equal {
+			if current != nil {
+				out = append(out, *current)
+				current = nil
+			}
+			index++
+			continue
+		}
+		if current == nil {
+			current = &region{start: index, end: index}
+		}
+		if line.Op == Delete {
+			index++
+			current.end = index
+		} else {
+			current.lines = append(current.lines, line.Text)
+		}
+	}
+	if current != nil {
+		out = append(out, *current)
+	}
+	return out
+}
+
+// Merge3 merges the changes made to base by ours and theirs. Where both
+// sides changed the same region differently the merged output keeps ours
+// and the region is reported as a conflict.
+func Merge3(base, ours, theirs []string) ([]string, []Conflict) {
+	a := regions(Lines(base, ours))
+	b := regions(Lines(base, theirs))
+
+	type tagged struct {
+		region
+		ours bool
+	}
+	all := make([]tagged, 0, len(a)+len(b))
+	for _, r := range a {
+		all = append(all, tagged{r, true})
+	}
+	for _, r := range b {
+		all = append(all, tagged{r, false})
+	}
+	// insertions sort before replacements starting at the same line
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].start != all[j].start {
+			return all[i].start < all[j].start
+		}
+		return all[i].end < all[j].end
+	})
+
+	var merged []string
+	var conflicts []Conflict
+	index := 0
+	for i := 0; i < len(all); {
+		start, end := all[i].start, all[i].end
+		var ourSide, theirSide []region
+		for ; i < len(all); i++ {
+			r := all[i]
+			joins := r.start < end || (r.start == start && start == end && r.start == r.end)
+			if len(ourSide)+len(theirSide) > 0 && !joins {
+				break
+			}
+			end = max(end, r.end)
+			if r.ours {
+				ourSide = append(ourSide, r.region)
+			} else {
+				theirSide = append(theirSide, r.region)
+			}
+		}
+
+		merged = append(merged, base[index:start]...)
+		index = end
+
+		oursText := rewrite(base, start, end, ourSide)
+		theirsText := rewrite(base, start, end, theirSide)
+		switch {
+		case len(theirSide) == 0:
+			merged = append(merged, oursText...)
+		case len(ourSide) == 0:
+			merged = append(merged, theirsText...)
+		case equalLines(oursText, theirsText):
+			merged = append(merged, oursText...)
+		default:
+			merged = append(merged, oursText...)
+			conflicts = append(conflicts, Conflict{
+				BaseStart: start,
+				BaseEnd:   end,
+				Ours:      oursText,
+				Theirs:    theirsText,
+			})
+		}
+	}
+	merged = append(merged, base[index:]...)
+
+	return merged, conflicts
+}
+
+// rewrite applies one side's regions to base[start:end]
+func rewrite(base []string, start, end int, side []region) []string {
+	var out []string
+	index := start
+	for _, r := range side {
+		out = append(out, base[index:r.start]...)
+		out = append(out, r.lines...)
+		index = r.end
+	}
+	return append(out, base[index:end]...)
+}
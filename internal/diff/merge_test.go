@@ -0,0 +1,82 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge3OneSideUnchanged(t *testing.T) {
+	for _, tt := range pairs {
+		t.Run(tt.name, func(t *testing.T) {
+			base, changed := SplitLines(tt.a), SplitLines(tt.b)
+
+			merged, conflicts := Merge3(base, changed, base)
+			if len(conflicts) > 0 || strings.Join(merged, "") != tt.b {
+				t.Errorf("Merge3(base, changed, base) = %q with %d conflict(s), want %q", strings.Join(merged, ""), len(conflicts), tt.b)
+			}
+			merged, conflicts = Merge3(base, base, changed)
+			if len(conflicts) > 0 || strings.Join(merged, "") != tt.b {
+				t.Errorf("Merge3(base, base, changed) = %q with %d conflict(s), want %q", strings.Join(merged, ""), len(conflicts), tt.b)
+			}
+		})
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := numbered(1, 20, nil)
+	tests := []struct {
+		name      string
+		ours      string
+		theirs    string
+		want      string
+		conflicts int
+	}{
+		{
+			name:   "separate changes combine",
+			ours:   numbered(1, 20, map[int]string{3: "three"}),
+			theirs: numbered(1, 20, map[int]string{17: "seventeen"}),
+			want:   numbered(1, 20, map[int]string{3: "three", 17: "seventeen"}),
+		},
+		{
+			name:   "the same change on both sides",
+			ours:   numbered(1, 20, map[int]string{10: "ten"}),
+			theirs: numbered(1, 20, map[int]string{10: "ten"}),
+			want:   numbered(1, 20, map[int]string{10: "ten"}),
+		},
+		{
+			name:      "different changes to one line keep ours",
+			ours:      numbered(1, 20, map[int]string{10: "ten"}),
+			theirs:    numbered(1, 20, map[int]string{10: "TEN"}),
+			want:      numbered(1, 20, map[int]string{10: "ten"}),
+			conflicts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := Merge3(SplitLines(base), SplitLines(tt.ours), SplitLines(tt.theirs))
+			if got := strings.Join(merged, ""); got != tt.want {
+				t.Errorf("Merge3 = %q, want %q", got, tt.want)
+			}
+			if len(conflicts) != tt.conflicts {
+				t.Errorf("Merge3 reported %d conflict(s), want %d", len(conflicts), tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestMerge3ConflictRange(t *testing.T) {
+	base := SplitLines(numbered(1, 20, nil))
+	ours := SplitLines(numbered(1, 20, map[int]string{10: "ten"}))
+	theirs := SplitLines(numbered(1, 20, map[int]string{10: "TEN"}))
+	_, conflicts := Merge3(base, ours, theirs)
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts, want 1", len(conflicts))
+	}
+	c := conflicts[0]
+	if c.BaseStart != 9 || c.BaseEnd != 10 {
+		t.Errorf("conflict covers base [%d, %d), want [9, 10)", c.BaseStart, c.BaseEnd)
+	}
+	if strings.Join(c.Ours, "") != "ten\n" || strings.Join(c.Theirs, "") != "TEN\n" {
+		t.Errorf("conflict sides = %q and %q", c.Ours, c.Theirs)
+	}
+}
@@ -0,0 +1,153 @@
+package diff
+
+import "sort"
+
+// Preimage returns the lines the hunk expects to find in the old version
+func (h Hunk) Preimage() []string {
+	var lines []string
+	for _, line := range h.Lines {
+		if line.Op != Insert {
+			lines = append(lines, line.Text)
+		}
+	}
+	return lines
+}
+
+// Postimage returns the lines the hunk leaves in the new version
+func (h Hunk) Postimage() []string {
+	var lines []string
+	for _, line := range h.Lines {
+		if line.Op != Delete {
+			lines = append(lines, line.Text)
+		}
+	}
+	return lines
+}
+
+// Reverse returns the hunk that undoes h
+func (h Hunk) Reverse() Hunk {
+	r := Hunk{
+		OldStart: h.NewStart,
+		OldLines: h.NewLines,
+		NewStart: h.OldStart,
+		NewLines: h.OldLines,
+		Lines:    make([]Line, len(h.Lines)),
+	}
+	for i, line := range h.Lines {
+		switch line.Op {
+		case Insert:
+			line.Op = Delete
+		case Delete:
+			line.Op = Insert
+		}
+		r.Lines[i] = line
+	}
+	return r
+}
+
+// oldIndex is the 0-based position in the old version where the hunk starts
+func (h Hunk) oldIndex() int {
+	if h.OldLines == 0 {
+		return h.OldStart
+	}
+	return h.OldStart - 1
+}
+
+// Apply patches lines with hunks, tolerating shifted positions the way
+// patch(1) does. Hunks whose change is already present are skipped. The
+// indexes of hunks that could not be placed are returned in failed.
+func Apply(lines []string, hunks []Hunk) (result []string, failed []int) {
+	order := make([]int, len(hunks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return hunks[order[a]].OldStart < hunks[order[b]].OldStart
+	})
+
+	pos := 0
+	offset := 0
+	for _, i := range order {
+		h := hunks[i]
+		pre, post := h.Preimage(), h.Postimage()
+
+		if len(pre) == 0 {
+			// without any anchor the hunk can only create content from nothing
+			switch {
+			case len(lines) == 0:
+				result = append(result, post...)
+			case !equalLines(lines, post):
+				failed = append(failed, i)
+			}
+			continue
+		}
+
+		expected := h.oldIndex() + offset
+		at := find(lines, pre, expected, pos)
+		if at < 0 {
+			if find(lines, post, expected, pos) < 0 {
+				failed = append(failed, i)
+			}
+			continue
+		}
+
+		result = append(result, lines[pos:at]...)
+		result = append(result, post...)
+		pos = at + len(pre)
+		offset = at - h.oldIndex()
+	}
+	result = append(result, lines[pos:]...)
+
+	sort.Ints(failed)
+	return result, failed
+}
+
+// find returns the index nearest to expected, and not before from, where
+// want occurs in lines, or -1
+func find(lines, want []string, expected, from int) int {
+	last := len(lines) - len(want)
+	if last < from {
+		return -1
+	}
+	expected = min(max(expected, from), last)
+	for delta := 0; expected-delta >= from || expected+delta <= last; delta++ {
+		if at := expected - delta; at >= from && equalLines(lines[at:at+len(want)], want) {
+			return at
+		}
+		if at := expected + delta; delta > 0 && at <= last && equalLines(lines[at:at+len(want)], want) {
+			return at
+		}
+	}
+	return -1
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Renumber sorts hunks by their old position and recomputes the new-side
+// start lines as if only these hunks were applied to the old version
+func Renumber(hunks []Hunk) []Hunk {
+	out := append([]Hunk(nil), hunks...)
+	sort.SliceStable(out, func(a, b int) bool {
+		return out[a].OldStart < out[b].OldStart
+	})
+	delta := 0
+	for i := range out {
+		index := out[i].oldIndex() + delta
+		out[i].NewStart = index
+		if out[i].NewLines > 0 {
+			out[i].NewStart++
+		}
+		delta += out[i].NewLines - out[i].OldLines
+	}
+	return out
+}
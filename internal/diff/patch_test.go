@@ -0,0 +1,98 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyRoundTrip(t *testing.T) {
+	for _, tt := range pairs {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := SplitLines(tt.a), SplitLines(tt.b)
+			hunks := Hunks(a, b, DefaultContext)
+
+			got, failed := Apply(a, hunks)
+			if len(failed) > 0 {
+				t.Fatalf("Apply failed hunks %v", failed)
+			}
+			if strings.Join(got, "") != tt.b {
+				t.Errorf("Apply(a, Hunks(a, b)) = %q, want %q", strings.Join(got, ""), tt.b)
+			}
+
+			reversed := make([]Hunk, len(hunks))
+			for i, h := range hunks {
+				reversed[i] = h.Reverse()
+			}
+			got, failed = Apply(b, reversed)
+			if len(failed) > 0 {
+				t.Fatalf("Apply of reversed hunks failed %v", failed)
+			}
+			if strings.Join(got, "") != tt.a {
+				t.Errorf("Apply(b, reversed) = %q, want %q", strings.Join(got, ""), tt.a)
+			}
+		})
+	}
+}
+
+func TestApplyShifted(t *testing.T) {
+	a := SplitLines(numbered(1, 20, nil))
+	b := SplitLines(numbered(1, 20, map[int]string{15: "fifteen"}))
+	hunks := Hunks(a, b, DefaultContext)
+
+	// three lines inserted at the top move the hunk down
+	shifted := append(SplitLines("x\ny\nz\n"), a...)
+	got, failed := Apply(shifted, hunks)
+	if len(failed) > 0 {
+		t.Fatalf("Apply failed hunks %v", failed)
+	}
+	want := append(SplitLines("x\ny\nz\n"), b...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Apply to shifted lines = %q, want %q", got, want)
+	}
+}
+
+func TestApplyAlreadyApplied(t *testing.T) {
+	a := SplitLines("a\nb\nc\n")
+	b := SplitLines("a\nB\nc\n")
+	got, failed := Apply(b, Hunks(a, b, DefaultContext))
+	if len(failed) > 0 || !reflect.DeepEqual(got, b) {
+		t.Errorf("Apply to the new version = %q, failed %v; want it unchanged", got, failed)
+	}
+}
+
+func TestApplyFails(t *testing.T) {
+	a := SplitLines("a\nb\nc\n")
+	b := SplitLines("a\nB\nc\n")
+	unrelated := SplitLines("p\nq\nr\n")
+	got, failed := Apply(unrelated, Hunks(a, b, DefaultContext))
+	if !reflect.DeepEqual(failed, []int{0}) {
+		t.Errorf("Apply to unrelated lines failed %v, want [0]", failed)
+	}
+	if !reflect.DeepEqual(got, unrelated) {
+		t.Errorf("Apply to unrelated lines = %q, want them unchanged", got)
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	a := SplitLines(numbered(1, 30, nil))
+	b := SplitLines(numbered(1, 30, map[int]string{5: "five\nfive again", 25: "twenty-five"}))
+	hunks := Hunks(a, b, DefaultContext)
+	if len(hunks) != 2 {
+		t.Fatalf("got %d hunks, want 2", len(hunks))
+	}
+
+	// on its own the second hunk starts where it does in the old version
+	alone := Renumber(hunks[1:])
+	if alone[0].NewStart != hunks[1].OldStart {
+		t.Errorf("second hunk alone starts at %d, want %d", alone[0].NewStart, hunks[1].OldStart)
+	}
+
+	// together, in any order, they match what the diff computed
+	both := Renumber([]Hunk{hunks[1], hunks[0]})
+	for i := range both {
+		if both[i].NewStart != hunks[i].NewStart {
+			t.Errorf("hunk %d starts at %d, want %d", i, both[i].NewStart, hunks[i].NewStart)
+		}
+	}
+}
@@ -2,12 +2,20 @@ package metadata
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
+
+	"github.com/tesh254/stick/internal/constants"
+	"github.com/tesh254/stick/internal/stickdir"
 )
 
+// LoadMetadata reads the legacy metadata store. stick no longer writes it;
+// it is only read to fold old branches into the state file.
 func LoadMetadata() Metadata {
-	data, err := os.ReadFile(".stick/metadata.json")
+	path, err := stickdir.File(constants.METADATA_FILE)
+	if err != nil {
+		return Metadata{VirtualBranches: make(map[string]VirtualBranch)}
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return Metadata{VirtualBranches: make(map[string]VirtualBranch)}
 	}
@@ -15,15 +23,3 @@ func LoadMetadata() Metadata {
 	json.Unmarshal(data, &metadata)
 	return metadata
 }
-
-func SaveMetadata(metadata Metadata) {
-	data, err := json.MarshalIndent(metadata, "", "	")
-	if err != nil {
-		fmt.Println("failed to marshal metadata: ", err)
-		return
-	}
-	err = os.WriteFile(".stick/metadata.json", data, 0644)
-	if err != nil {
-		fmt.Println("failed to write metadata: ", err)
-	}
-}
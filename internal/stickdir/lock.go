@@ -0,0 +1,101 @@
+package stickdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const lockFile = "state.lock"
+
+// lockTimeout is how long Lock waits for another stick process to finish
+const lockTimeout = 10 * time.Second
+
+// Lock takes the exclusive advisory lock guarding stick's files. It waits
+// for other stick processes to release it and returns a function that
+// releases it again.
+func Lock() (func(), error) {
+	dir, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("locking stick state: %v", err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("another stick process is holding %s", f.Name())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return func() {
+		unlock(f)
+		f.Close()
+	}, nil
+}
+
+// WriteFileAtomic replaces path with data so that readers, and a crash at
+// any point, only ever see the old or the new content
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// WriteFileSync writes data to path and flushes it to disk
+func WriteFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+package stickdir
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tesh254/stick/internal/constants"
+)
+
+// Path returns the directory holding stick's own files. It lives inside the
+// Git common directory, so every subdirectory and linked worktree of a
+// repository shares it and it never shows up as a working tree change.
+func Path() (string, error) {
+	output, err := exec.Command("git", "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return "", fmt.Errorf("not a git repository")
+	}
+	commonDir, err := filepath.Abs(strings.TrimSpace(string(output)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(commonDir, constants.STICK_DIR), nil
+}
+
+// File returns the path of one of stick's files
+func File(name string) (string, error) {
+	dir, err := Path()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// MigrateLegacy moves files left in the old <worktree>/.stick directory into
+// the Git directory. Files already present in the new location win.
+func MigrateLegacy(gitRoot string) error {
+	if gitRoot == "" {
+		return nil
+	}
+	legacyDir := filepath.Join(gitRoot, constants.LEGACY_STICK_DIR)
+	if _, err := os.Stat(legacyDir); err != nil {
+		return nil
+	}
+
+	dir, err := Path()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range []string{constants.STATE_FILE, constants.METADATA_FILE} {
+		legacyFile := filepath.Join(legacyDir, name)
+		target := filepath.Join(dir, name)
+		if _, err := os.Stat(legacyFile); err != nil {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(legacyFile, target); err != nil {
+			return fmt.Errorf("moving %s into %s: %v", legacyFile, dir, err)
+		}
+	}
+
+	// only succeeds once nothing else is left in the old directory
+	os.Remove(legacyDir)
+	return nil
+}
+
+// IsLegacyPath reports whether a repository-relative path belongs to the
+// old in-tree .stick directory
+func IsLegacyPath(path string) bool {
+	path = filepath.ToSlash(path)
+	return path == constants.LEGACY_STICK_DIR || strings.HasPrefix(path, constants.LEGACY_STICK_DIR+"/")
+}
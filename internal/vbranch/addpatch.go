@@ -0,0 +1,406 @@
+package vbranch
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss/v2"
+	"github.com/tesh254/stick/internal/diff"
+)
+
+// pendingHunk is a working tree change no virtual branch holds yet
+type pendingHunk struct {
+	File    string
+	OldFile string // source of a rename or copy, offered whole
+	Type    string
+	Hunk    diff.Hunk
+	Binary  string // for a binary change, which has no lines, its summary
+	OldMode string // mode of a removed file, or before a mode change
+	NewMode string // mode of an added file, or after a mode change
+}
+
+// label names the file or files the pending hunk touches
+func (p pendingHunk) label() string {
+	if p.OldFile != "" {
+		return fmt.Sprintf("%s %s -> %s", p.Type, p.OldFile, p.File)
+	}
+	return p.File
+}
+
+// renameAssigned reports whether any branch holds the rename or copy
+func renameAssigned(pair renamePair) bool {
+	for _, branch := range state.Branches {
+		for _, hunk := range branch.Hunks {
+			if hunk.File == pair.Dest && hunk.OldFile == pair.Source {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assignedKeys returns the change keys of every hunk any branch holds for filename
+func assignedKeys(filename string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, branch := range state.Branches {
+		for _, hunk := range branch.Hunks {
+			if hunk.File == filename {
+				keys[changeKey(hunk.Content)] = true
+			}
+		}
+	}
+	return keys
+}
+
+// binaryAssigned reports whether any branch holds the binary change that
+// leaves filename with content
+func binaryAssigned(filename, content string, exists bool) bool {
+	blob := ""
+	if exists {
+		var err error
+		if blob, err = hashContent(content, false); err != nil {
+			return false
+		}
+	}
+	for _, branch := range state.Branches {
+		for _, hunk := range branch.Hunks {
+			if hunk.File == filename && hunk.Binary && hunk.NewBlob == blob {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesPaths reports whether filename is one of paths or lies under one
+// of them; no paths matches everything
+func matchesPaths(filename string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		if path == "." || filename == path || strings.HasPrefix(filename, strings.TrimSuffix(path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unassignedHunks diffs every changed file against HEAD and returns the
+// hunks no branch holds. A hunk some of whose pieces were assigned after
+// splitting is offered as its remaining pieces; a rename is offered as one.
+func unassignedHunks(paths []string) ([]pendingHunk, error) {
+	var pending []pendingHunk
+	pairs, err := detectRenames()
+	if err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]bool)
+	for _, pair := range pairs {
+		renamed[pair.Dest] = true
+		if pair.Kind == "rename" {
+			renamed[pair.Source] = true
+		}
+		if renameAssigned(pair) || !(matchesPaths(pair.Dest, paths) || matchesPaths(pair.Source, paths)) {
+			continue
+		}
+		base, _ := getHeadContent(pair.Source)
+		current, _, err := readWorkingFile(pair.Dest)
+		if err != nil {
+			return nil, err
+		}
+		p := pendingHunk{File: pair.Dest, OldFile: pair.Source, Type: pair.Kind, Hunk: wholeFileHunk(base, current)}
+		if isBinary(base) || isBinary(current) {
+			p.Hunk = diff.Hunk{}
+			p.Binary = fmt.Sprintf("binary changed (%s → %s)", formatSize(int64(len(base))), formatSize(int64(len(current))))
+		}
+		pending = append(pending, p)
+	}
+
+	changed, err := changedPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range changed {
+		if renamed[filename] || !matchesPaths(filename, paths) {
+			continue
+		}
+
+		base, inHead := getHeadContent(filename)
+		current, inWorktree, err := readWorkingFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		hunkType := "modify"
+		switch {
+		case !inHead && !inWorktree:
+			continue
+		case !inHead:
+			hunkType = "add"
+		case !inWorktree:
+			hunkType = "remove"
+		}
+
+		if isBinary(base) || isBinary(current) {
+			if !binaryAssigned(filename, current, inWorktree) {
+				summary := fmt.Sprintf("binary changed (%s → %s)", formatSize(int64(len(base))), formatSize(int64(len(current))))
+				pending = append(pending, pendingHunk{File: filename, Type: hunkType, Binary: summary})
+			}
+			continue
+		}
+
+		headMode := getHeadMode(filename)
+		mode, _, err := worktreeMode(filename)
+		if err != nil {
+			return nil, err
+		}
+		if hunkType == "modify" && headMode != mode && !modeAssigned(nil, filename, mode) {
+			pending = append(pending, pendingHunk{File: filename, Type: "mode", OldMode: headMode, NewMode: mode})
+		}
+		oldMode, newMode := creationModes(hunkType, headMode, mode)
+
+		keys := assignedKeys(filename)
+		for _, h := range diff.Hunks(diff.SplitLines(base), diff.SplitLines(current), diff.DefaultContext) {
+			if keys[changeKey(h.Body())] {
+				continue
+			}
+			pieces := h.Split()
+			var open []diff.Hunk
+			for _, piece := range pieces {
+				if !keys[changeKey(piece.Body())] {
+					open = append(open, piece)
+				}
+			}
+			if len(open) == len(pieces) {
+				open = []diff.Hunk{h}
+			}
+			for _, piece := range open {
+				pending = append(pending, pendingHunk{File: filename, Type: hunkType, Hunk: piece, OldMode: oldMode, NewMode: newMode})
+			}
+		}
+	}
+	return pending, nil
+}
+
+// assignHunk records a single working tree hunk on branch, renumbering the
+// branch's other hunks in the file so their new-side ranges stay correct
+func assignHunk(branch *VirtualBranch, p pendingHunk) error {
+	if p.OldFile != "" {
+		current, err := worktreeVersion(p.File)
+		if err != nil {
+			return err
+		}
+		return recordRename(branch, renamePair{Kind: p.Type, Source: p.OldFile, Dest: p.File}, current)
+	}
+	if p.Binary != "" {
+		current, err := worktreeVersion(p.File)
+		if err != nil {
+			return err
+		}
+		return recordBinary(branch, p.File, current, p.Type)
+	}
+	if p.Type == "mode" {
+		if !recordMode(branch, p.File, p.OldMode, p.NewMode) {
+			return fmt.Errorf("the mode change of %s already belongs to another virtual branch", p.File)
+		}
+		return nil
+	}
+	if err := checkRemoteBase(branch); err != nil {
+		return err
+	}
+	headBlob := getHeadBlob(p.File)
+	taken := make(map[string]bool)
+	held := false
+	for _, hunk := range branch.Hunks {
+		if hunk.File == p.File && !hunk.Conflicted {
+			taken[hunk.ID] = true
+			held = held || !hunk.isMode()
+		}
+	}
+	if held && getBaseBlob(branch, p.File) != headBlob {
+		return fmt.Errorf("branch '%s' holds hunks of %s recorded against an older base; run 'stick rebase' first", branch.Name, p.File)
+	}
+
+	// the hunk must apply to HEAD together with the branch's others before
+	// the branch is touched
+	patches := []diff.Hunk{p.Hunk}
+	for _, hunk := range branch.Hunks {
+		if hunk.File == p.File && !hunk.Conflicted && !hunk.isMode() && !hunk.Binary && !hunk.isRename() {
+			patch, err := hunk.patch()
+			if err != nil {
+				return err
+			}
+			patches = append(patches, patch)
+		}
+	}
+	base, _ := getHeadContent(p.File)
+	if _, failed := diff.Apply(diff.SplitLines(base), patches); len(failed) > 0 {
+		return fmt.Errorf("the hunk does not apply to %s together with the other hunks branch '%s' holds for it", p.File, branch.Name)
+	}
+
+	hunk := newHunk(p.File, p.Hunk, p.Type, taken)
+	hunk.OldMode, hunk.NewMode = p.OldMode, p.NewMode
+	branch.Hunks = append(branch.Hunks, hunk)
+	if branch.BaseBlobs == nil {
+		branch.BaseBlobs = make(map[string]string)
+	}
+	if branch.Files == nil {
+		branch.Files = make(map[string]string)
+	}
+	branch.BaseBlobs[p.File] = headBlob
+	if head, err := getHeadCommit(); err == nil {
+		branch.BaseCommit = head
+	}
+
+	if err := rebuildFile(branch, p.File); err != nil {
+		return err
+	}
+	branch.UpdatedAt = time.Now()
+	return nil
+}
+
+const addPatchHelp = `y - assign this hunk to the current branch
+1-9 - assign this hunk to the branch at that position (or type its name)
+c - create a new branch and assign this hunk to it
+s - split this hunk into smaller hunks
+n - skip this hunk
+q - quit; hunks assigned so far are kept
+? - print help`
+
+// AddPatch walks the working tree hunks that no branch holds yet and asks,
+// one at a time, which branch each belongs to
+func AddPatch(paths []string) error {
+	if Structured() {
+		return fmt.Errorf("stick add -p is interactive and cannot print --json or --format output")
+	}
+	pending, err := unassignedHunks(paths)
+	if err != nil {
+		return fmt.Errorf("reading changes: %w", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("no unassigned changes")
+		return nil
+	}
+
+	current := state.Branches[state.CurrentBranch]
+	var keys []string
+	for i, branch := range sortedBranches() {
+		marker := ""
+		if branch.ID == state.CurrentBranch {
+			marker = "*"
+		}
+		keys = append(keys, fmt.Sprintf("%d %s%s", i+1, branch.Name, marker))
+	}
+	fmt.Printf("branches: %s\n", strings.Join(keys, ", "))
+
+	in := bufio.NewReader(os.Stdin)
+	assigned, skipped, changed := 0, 0, false
+prompt:
+	for i := 0; i < len(pending); i++ {
+		p := pending[i]
+		fmt.Println()
+		body := diffHunkStyle.Render(p.Hunk.Header()) + "\n" + formatHunkBody(p.Hunk.Body(), false)
+		if p.Binary != "" {
+			body = p.Binary + "\n"
+		} else if p.Type == "mode" {
+			body = modeSummary(p.OldMode, p.NewMode) + "\n"
+		} else if p.OldFile != "" {
+			body = ""
+			for _, h := range diff.Group(p.Hunk.Lines, diff.DefaultContext) {
+				body += diffHunkStyle.Render(h.Header()) + "\n" + formatHunkBody(h.Body(), false)
+			}
+		}
+		lipgloss.Print(diffFileStyle.Render(p.label()) + "\n" + body)
+		fmt.Printf("(%d/%d) assign to %s [y,n,s,c,1-%d,q,?]? ", i+1, len(pending), current.Name, len(state.Branches))
+
+		line, err := in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if err != nil && answer == "" {
+			fmt.Println()
+			break
+		}
+
+		var target *VirtualBranch
+		created := false
+		switch answer {
+		case "y":
+			target = current
+		case "n":
+			skipped++
+			continue
+		case "q":
+			break prompt
+		case "s":
+			if p.OldFile != "" || p.Binary != "" || p.Type == "mode" {
+				fmt.Printf("this change is kept whole and cannot be split\n")
+				i--
+				continue
+			}
+			pieces := p.Hunk.Split()
+			if len(pieces) < 2 {
+				fmt.Println("this hunk cannot be split further")
+				i--
+				continue
+			}
+			fmt.Printf("split into %d hunks\n", len(pieces))
+			split := make([]pendingHunk, 0, len(pending)+len(pieces)-1)
+			split = append(split, pending[:i]...)
+			for _, piece := range pieces {
+				split = append(split, pendingHunk{File: p.File, Type: p.Type, Hunk: piece, OldMode: p.OldMode, NewMode: p.NewMode})
+			}
+			pending = append(split, pending[i+1:]...)
+			i--
+			continue
+		case "c":
+			fmt.Print("new branch name: ")
+			name, _ := in.ReadString('\n')
+			name = strings.TrimSpace(name)
+			if err := validateBranchName(name); err != nil {
+				fmt.Println(err)
+				i--
+				continue
+			}
+			target = newVirtualBranch(name)
+			state.Branches[target.ID] = target
+			created = true
+		case "", "?":
+			fmt.Println(addPatchHelp)
+			i--
+			continue
+		default:
+			target, err = resolveBranch(answer)
+			if err != nil {
+				fmt.Println(err)
+				i--
+				continue
+			}
+		}
+
+		if err := assignHunk(target, p); err != nil {
+			// a branch created for this hunk is not kept empty
+			if created {
+				delete(state.Branches, target.ID)
+			}
+			fmt.Printf("error: %v\n", err)
+			skipped++
+			continue
+		}
+		if created {
+			fmt.Printf("created virtual branch: %s\n", target.Name)
+		}
+		assigned++
+		changed = true
+		fmt.Printf("assigned to %s\n", target.Name)
+	}
+
+	if changed {
+		if err := saveState(); err != nil {
+			return fmt.Errorf("saving state: %w", err)
+		}
+	}
+	fmt.Printf("assigned %d hunk(s), skipped %d\n", assigned, skipped)
+	return nil
+}
@@ -0,0 +1,311 @@
+package vbranch
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binarySniffLength is how much of a file is checked for NUL bytes, as git does
+const binarySniffLength = 8000
+
+// isBinary reports whether content looks binary to git: a NUL byte near the start
+func isBinary(content string) bool {
+	return strings.IndexByte(content[:min(len(content), binarySniffLength)], 0) >= 0
+}
+
+// hashContent returns the blob ID of content, storing the blob in the
+// object database when write is set
+func hashContent(content string, write bool) (string, error) {
+	args := []string{"hash-object", "--stdin"}
+	if write {
+		args = append(args, "-w")
+	}
+	cmd := gitCommand(args...)
+	cmd.Stdin = strings.NewReader(content)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("hashing content: %v", err)
+	}
+	blob := strings.TrimSpace(string(output))
+	if write {
+		queueBlob(blob)
+	}
+	return blob, nil
+}
+
+// blobSize returns the size of a blob in bytes; the missing blob "" is empty
+func blobSize(blob string) int64 {
+	if blob == "" {
+		return 0
+	}
+	size, err := runGit(nil, "", "cat-file", "-s", blob)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(size, 10, 64)
+	return n
+}
+
+// formatSize renders a byte count the way stick prints binary changes
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// binarySummary describes a binary hunk, e.g. "binary changed (1.2 KiB → 3.4 KiB)"
+func binarySummary(hunk Hunk) string {
+	return fmt.Sprintf("binary changed (%s → %s)", formatSize(blobSize(hunk.OldBlob)), formatSize(blobSize(hunk.NewBlob)))
+}
+
+// binaryHunks returns the branch's binary hunks that change a file in
+// place, leaving out renames and hunks left conflicted by a rebase
+func binaryHunks(branch *VirtualBranch) []Hunk {
+	var out []Hunk
+	for _, hunk := range branch.Hunks {
+		if hunk.Binary && !hunk.isRename() && !hunk.Conflicted {
+			out = append(out, hunk)
+		}
+	}
+	return out
+}
+
+// newBinaryHunk records the change from the blob oldBlob to current as a
+// single opaque hunk, storing current in the object database
+func newBinaryHunk(filename, oldBlob, current string, exists bool, hunkType string, taken map[string]bool) (Hunk, error) {
+	newBlob := ""
+	if exists {
+		var err error
+		if newBlob, err = hashContent(current, true); err != nil {
+			return Hunk{}, err
+		}
+	}
+	id := hunkID(filename, "binary\x00"+oldBlob+"\x00"+newBlob, taken)
+	taken[id] = true
+	return Hunk{
+		ID:        id,
+		File:      filename,
+		Type:      hunkType,
+		Binary:    true,
+		OldBlob:   oldBlob,
+		NewBlob:   newBlob,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// recordBinary stores a binary change to filename on branch as one hunk,
+// replacing whatever the branch held for the file
+func recordBinary(branch *VirtualBranch, filename string, current fileVersion, hunkType string) error {
+	if err := checkRemoteBase(branch); err != nil {
+		return err
+	}
+	oldBlob := getHeadBlob(filename)
+	taken := make(map[string]bool)
+	kept := branch.Hunks[:0]
+	for _, hunk := range branch.Hunks {
+		if hunk.File != filename && hunk.OldFile != filename {
+			kept = append(kept, hunk)
+			taken[hunk.ID] = true
+		}
+	}
+	hunk, err := newBinaryHunk(filename, oldBlob, current.Content, current.Exists, hunkType, taken)
+	if err != nil {
+		return err
+	}
+	headMode := getHeadMode(filename)
+	hunk.OldMode, hunk.NewMode = creationModes(hunkType, headMode, current.Mode)
+	for _, other := range state.Branches {
+		if other.ID == branch.ID {
+			continue
+		}
+		for _, held := range other.Hunks {
+			if held.File == filename && held.Binary && held.NewBlob == hunk.NewBlob {
+				return fmt.Errorf("the binary change to %s already belongs to virtual branch %s", filename, other.Name)
+			}
+		}
+	}
+
+	branch.Hunks = append(kept, hunk)
+	if hunkType == "modify" && headMode != current.Mode {
+		recordMode(branch, filename, headMode, current.Mode)
+	}
+	if branch.BaseBlobs == nil {
+		branch.BaseBlobs = make(map[string]string)
+	}
+	if branch.Files == nil {
+		branch.Files = make(map[string]string)
+	}
+	branch.BaseBlobs[filename] = oldBlob
+	recordBaseCommit(branch)
+
+	delete(branch.Files, filename)
+	removeDeletedFile(branch, filename)
+	if current.Exists {
+		branch.Files[filename] = hunk.NewBlob
+	} else {
+		branch.DeletedFiles = append(branch.DeletedFiles, filename)
+	}
+	branch.UpdatedAt = time.Now()
+	return nil
+}
+
+// writeBlob puts the content of blob at filename with the Git mode mode,
+// or removes the file when blob is ""
+func writeBlob(filename, blob, mode string) error {
+	if blob == "" {
+		if err := os.Remove(worktreePath(filename)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := getBlobContent(blob)
+	if err != nil {
+		return err
+	}
+	return writeFileMode(filename, content, mode)
+}
+
+// worktreeBlob returns the blob ID the working tree copy of filename would
+// have, "" when it does not exist, and the file's Git mode
+func worktreeBlob(filename string) (string, string, error) {
+	content, exists, err := readWorkingFile(filename)
+	if err != nil || !exists {
+		return "", "", err
+	}
+	mode, _, err := worktreeMode(filename)
+	if err != nil {
+		return "", "", err
+	}
+	blob, err := hashContent(content, false)
+	return blob, mode, err
+}
+
+// patchBinary swaps a binary file between its recorded old and new blobs,
+// or back when reverse is set. A file edited since is left alone and
+// reported as a conflict: binary content cannot be merged.
+func patchBinary(hunk Hunk, reverse bool) ([]HunkConflict, error) {
+	from, to := hunk.OldBlob, hunk.NewBlob
+	fromFile, toFile := hunk.File, hunk.File
+	if hunk.isRename() {
+		fromFile = hunk.OldFile
+	}
+	if reverse {
+		from, to = to, from
+		fromFile, toFile = toFile, fromFile
+	}
+
+	current, mode, err := worktreeBlob(fromFile)
+	if err != nil {
+		return nil, err
+	}
+	if fromFile != toFile {
+		// a binary rename: done when the source is gone and the
+		// destination holds the new content
+		if target, _, err := worktreeBlob(toFile); err != nil {
+			return nil, err
+		} else if current == "" && target == to {
+			return nil, nil
+		} else if target != "" {
+			return []HunkConflict{{HunkID: hunk.ID, File: hunk.File}}, nil
+		}
+	} else if current == to {
+		return nil, nil
+	}
+	if current != from {
+		return []HunkConflict{{HunkID: hunk.ID, File: hunk.File}}, nil
+	}
+
+	// a file being created takes the mode it was recorded with
+	if current == "" {
+		mode = hunk.NewMode
+		if reverse {
+			mode = hunk.OldMode
+		}
+	}
+	if err := writeBlob(toFile, to, orRegular(mode)); err != nil {
+		return nil, err
+	}
+	if fromFile != toFile {
+		if err := os.Remove(worktreePath(fromFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// fullBlobID spells out a blob ID for an index line, all zeros for none
+func fullBlobID(blob string) string {
+	if blob == "" {
+		return strings.Repeat("0", 40)
+	}
+	return blob
+}
+
+// gitBinaryAlphabet is the base85 alphabet of git's binary patches
+const gitBinaryAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// gitBinaryLiteral encodes content as a "literal" section of a git binary
+// patch: zlib-deflated, then base85 in lines of up to 52 bytes
+func gitBinaryLiteral(content string) string {
+	var deflated bytes.Buffer
+	w := zlib.NewWriter(&deflated)
+	w.Write([]byte(content))
+	w.Close()
+	data := deflated.Bytes()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "literal %d\n", len(content))
+	for len(data) > 0 {
+		n := min(len(data), 52)
+		if n <= 26 {
+			sb.WriteByte(byte('A' + n - 1))
+		} else {
+			sb.WriteByte(byte('a' + n - 27))
+		}
+		for i := 0; i < n; i += 4 {
+			var group uint32
+			for j := 0; j < 4; j++ {
+				group <<= 8
+				if i+j < n {
+					group |= uint32(data[i+j])
+				}
+			}
+			var chars [5]byte
+			for k := 4; k >= 0; k-- {
+				chars[k] = gitBinaryAlphabet[group%85]
+				group /= 85
+			}
+			sb.Write(chars[:])
+		}
+		sb.WriteByte('\n')
+		data = data[n:]
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// gitBinaryPatch renders a binary hunk as a git binary patch, with the
+// reverse section so git apply -R works too
+func gitBinaryPatch(hunk Hunk) (string, error) {
+	contents := make([]string, 2)
+	for i, blob := range []string{hunk.NewBlob, hunk.OldBlob} {
+		if blob == "" {
+			continue
+		}
+		content, err := getBlobContent(blob)
+		if err != nil {
+			return "", err
+		}
+		contents[i] = content
+	}
+	return "GIT binary patch\n" + gitBinaryLiteral(contents[0]) + gitBinaryLiteral(contents[1]), nil
+}
@@ -0,0 +1,426 @@
+package vbranch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tesh254/stick/internal/diff"
+)
+
+// blobAnchorRef keeps every blob stick refers to reachable, so git gc does
+// not prune lane contents. It points at a single commit whose tree lists
+// every anchored blob; a command that writes new blobs replaces it.
+const blobAnchorRef = "refs/stick/blobs"
+
+var (
+	knownBlobs    = make(map[string]string) // content -> blob ID of contents already in the object database
+	pendingBlobs  = make(map[string]bool)   // blobs written but not yet reachable from blobAnchorRef
+	anchoredCache map[string]bool           // blobs reachable from blobAnchorRef, read once per state lock
+)
+
+// queueBlob marks a blob just written to be anchored when the state lock
+// is released, unless the anchor already holds it
+func queueBlob(blob string) {
+	if anchored, err := anchoredSet(); err == nil && anchored[blob] {
+		return
+	}
+	pendingBlobs[blob] = true
+}
+
+// anchoredSet returns the blobs blobAnchorRef holds, reading them on first use
+func anchoredSet() (map[string]bool, error) {
+	if anchoredCache != nil {
+		return anchoredCache, nil
+	}
+	blobs, err := anchoredBlobs()
+	if err != nil {
+		return nil, err
+	}
+	anchoredCache = make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		anchoredCache[blob] = true
+	}
+	return anchoredCache, nil
+}
+
+// storeBlob puts content in the object database and returns its blob ID
+func storeBlob(content string) (string, error) {
+	if blob, ok := knownBlobs[content]; ok {
+		return blob, nil
+	}
+	blob, err := hashContent(content, true)
+	if err != nil {
+		return "", err
+	}
+	knownBlobs[content] = blob
+	return blob, nil
+}
+
+// setFileContent records content as the lane's version of filename
+func setFileContent(branch *VirtualBranch, filename, content string) error {
+	blob, err := storeBlob(content)
+	if err != nil {
+		return err
+	}
+	if branch.Files == nil {
+		branch.Files = make(map[string]string)
+	}
+	branch.Files[filename] = blob
+	return nil
+}
+
+// readBlobs reads many blobs with a single git process
+func readBlobs(blobs []string) (map[string]string, error) {
+	contents := make(map[string]string)
+	if len(blobs) == 0 {
+		return contents, nil
+	}
+	cmd := gitCommand("cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading blobs: %v", err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(output))
+	for _, blob := range blobs {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading blob %s: %v", blob, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[1] != "blob" {
+			return nil, fmt.Errorf("blob %s is missing from the object database", blob)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("reading blob %s: %v", blob, err)
+		}
+		content := make([]byte, size+1) // and the newline after it
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("reading blob %s: %v", blob, err)
+		}
+		contents[blob] = string(content[:size])
+	}
+	return contents, nil
+}
+
+// existingBlobs returns the blobs of the list that are in the object database
+func existingBlobs(blobs []string) (map[string]bool, error) {
+	exists := make(map[string]bool)
+	if len(blobs) == 0 {
+		return exists, nil
+	}
+	output, err := runGit(nil, strings.Join(blobs, "\n")+"\n", "cat-file", "--batch-check")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[1] == "blob" {
+			exists[fields[0]] = true
+		}
+	}
+	return exists, nil
+}
+
+// encodeState serialises a state for the state file and the operation log.
+// Hunk bodies are stored as blobs, so the document holds only their IDs.
+func encodeState(s *StickState, indent bool) ([]byte, error) {
+	for _, branch := range s.Branches {
+		for i := range branch.Hunks {
+			hunk := &branch.Hunks[i]
+			hunk.ContentBlob = ""
+			if hunk.Content == "" {
+				continue
+			}
+			blob, err := storeBlob(hunk.Content)
+			if err != nil {
+				return nil, err
+			}
+			hunk.ContentBlob = blob
+		}
+	}
+	if indent {
+		return json.MarshalIndent(s, "", "  ")
+	}
+	return json.Marshal(s)
+}
+
+// loadHunkContents fills in the bodies of the state's hunks from their blobs
+func loadHunkContents(s *StickState) error {
+	var blobs []string
+	seen := make(map[string]bool)
+	for _, branch := range s.Branches {
+		for _, hunk := range branch.Hunks {
+			if hunk.ContentBlob != "" && !seen[hunk.ContentBlob] {
+				seen[hunk.ContentBlob] = true
+				blobs = append(blobs, hunk.ContentBlob)
+			}
+		}
+	}
+	contents, err := readBlobs(blobs)
+	if err != nil {
+		return err
+	}
+
+	for _, branch := range s.Branches {
+		for i := range branch.Hunks {
+			hunk := &branch.Hunks[i]
+			if hunk.ContentBlob == "" {
+				continue
+			}
+			hunk.Content = contents[hunk.ContentBlob]
+			knownBlobs[hunk.Content] = hunk.ContentBlob
+			if lines, err := diff.ParseBody(hunk.Content); err == nil {
+				hunk.Context = diff.Hunk{Lines: lines}.Context()
+			}
+		}
+	}
+	return nil
+}
+
+// anchorBlobs makes the blobs written since the last call reachable from
+// blobAnchorRef, replacing its commit with one that lists them along with
+// everything it already held
+func anchorBlobs() error {
+	if len(pendingBlobs) == 0 {
+		return nil
+	}
+	anchored, err := anchoredSet()
+	if err != nil {
+		return err
+	}
+	blobs := make([]string, 0, len(anchored)+len(pendingBlobs))
+	for blob := range anchored {
+		blobs = append(blobs, blob)
+	}
+	for blob := range pendingBlobs {
+		if !anchored[blob] {
+			blobs = append(blobs, blob)
+		}
+	}
+	if err := writeBlobAnchor(blobs); err != nil {
+		return err
+	}
+	for blob := range pendingBlobs {
+		anchored[blob] = true
+	}
+	pendingBlobs = make(map[string]bool)
+	return nil
+}
+
+// writeBlobAnchor points blobAnchorRef at a new parentless commit listing blobs
+func writeBlobAnchor(blobs []string) error {
+	sort.Strings(blobs)
+	var tree strings.Builder
+	for _, blob := range blobs {
+		fmt.Fprintf(&tree, "100644 blob %s\t%s\n", blob, blob)
+	}
+	treeID, err := runGit(nil, tree.String(), "mktree")
+	if err != nil {
+		return fmt.Errorf("anchoring blobs: %v", err)
+	}
+
+	args := []string{"commit-tree", treeID, "-m", "stick blobs"}
+	env := []string{
+		"GIT_AUTHOR_NAME=stick", "GIT_AUTHOR_EMAIL=stick@localhost",
+		"GIT_COMMITTER_NAME=stick", "GIT_COMMITTER_EMAIL=stick@localhost",
+	}
+	commit, err := runGit(env, "", args...)
+	if err != nil {
+		return fmt.Errorf("anchoring blobs: %v", err)
+	}
+	if _, err := runGit(nil, "", "update-ref", blobAnchorRef, commit); err != nil {
+		return fmt.Errorf("anchoring blobs: %v", err)
+	}
+	return nil
+}
+
+// anchoredBlobs lists every blob reachable from blobAnchorRef. Anchor trees
+// name each blob after its ID, which tells blobs apart from the trees.
+func anchoredBlobs() ([]string, error) {
+	if _, err := runGit(nil, "", "rev-parse", "--verify", "--quiet", blobAnchorRef); err != nil {
+		return nil, nil
+	}
+	output, err := runGit(nil, "", "rev-list", "--objects", blobAnchorRef)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	for _, line := range strings.Split(output, "\n") {
+		if id, name, ok := strings.Cut(line, " "); ok && id == name {
+			blobs = append(blobs, id)
+		}
+	}
+	return blobs, nil
+}
+
+// stateBlobs adds every blob a state document refers to into refs. The
+// document may use any schema version; strings that are not blob IDs are
+// harmless, since only blobs stick anchored are ever pruned.
+func stateBlobs(data []byte, refs map[string]bool) {
+	var doc struct {
+		Branches map[string]struct {
+			Files     map[string]string `json:"files"`
+			BaseBlobs map[string]string `json:"base_blobs"`
+			Hunks     []Hunk            `json:"hunks"`
+		} `json:"branches"`
+	}
+	if json.Unmarshal(data, &doc) != nil {
+		return
+	}
+	for _, branch := range doc.Branches {
+		for _, blob := range branch.Files {
+			refs[blob] = true
+		}
+		for _, blob := range branch.BaseBlobs {
+			refs[blob] = true
+		}
+		for _, hunk := range branch.Hunks {
+			for _, blob := range []string{hunk.ContentBlob, hunk.OldBlob, hunk.NewBlob, hunk.ConflictBase} {
+				refs[blob] = true
+			}
+		}
+	}
+}
+
+// referencedBlobs returns the blobs the state and the operation log refer to
+func referencedBlobs(ops []Operation) (map[string]bool, error) {
+	refs := make(map[string]bool)
+	data, err := encodeState(state, false)
+	if err != nil {
+		return nil, err
+	}
+	stateBlobs(data, refs)
+
+	for _, op := range ops {
+		stateBlobs(op.Before, refs)
+		stateBlobs(op.After, refs)
+		for _, files := range []map[string]string{op.BeforeFiles, op.AfterFiles} {
+			for _, blob := range files {
+				refs[blob] = true
+			}
+		}
+	}
+	for blob := range refs {
+		if !isObjectID(blob) {
+			delete(refs, blob)
+		}
+	}
+	return refs, nil
+}
+
+// isObjectID reports whether s is a full SHA-1 or SHA-256 object ID
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// looseObjectPath returns where git keeps blob as a loose object
+func looseObjectPath(blob string) (string, error) {
+	return runGit(nil, "", "rev-parse", "--path-format=absolute", "--git-path", "objects/"+blob[:2]+"/"+blob[2:])
+}
+
+// gcBlobs drops operations older than expiry from the operation log, then
+// rewrites the anchor to hold only the blobs still referenced. The objects
+// themselves are left to git gc, which removes them once they are older
+// than its prune expiry, so a git command that is about to reuse one of
+// them meanwhile is never left pointing at a deleted object.
+func gcBlobs(dryRun bool, expiry time.Duration) (GCOutput, error) {
+	var out GCOutput
+	anchored, err := anchoredBlobs()
+	if err != nil {
+		return out, err
+	}
+	ops, err := readOplog()
+	if err != nil {
+		return out, err
+	}
+	head, err := readOplogHead()
+	if err != nil {
+		return out, err
+	}
+	ops, out.Expired = expireOperations(ops, head, time.Now().Add(-expiry))
+	refs, err := referencedBlobs(ops)
+	if err != nil {
+		return out, err
+	}
+	candidates := make([]string, 0, len(refs))
+	for blob := range refs {
+		candidates = append(candidates, blob)
+	}
+	exists, err := existingBlobs(candidates)
+	if err != nil {
+		return out, err
+	}
+	kept := make([]string, 0, len(exists))
+	for blob := range exists {
+		kept = append(kept, blob)
+	}
+	out.Kept = len(kept)
+
+	for _, blob := range anchored {
+		if exists[blob] {
+			continue
+		}
+		out.Pruned++
+		path, err := looseObjectPath(blob)
+		if err != nil {
+			return out, err
+		}
+		if info, err := os.Stat(path); err == nil {
+			out.Reclaimable += info.Size()
+		}
+	}
+	if dryRun {
+		return out, nil
+	}
+
+	if out.Expired > 0 {
+		if err := writeOplog(ops); err != nil {
+			return out, err
+		}
+	}
+	if len(kept) == 0 {
+		if _, err := runGit(nil, "", "update-ref", "-d", blobAnchorRef); err != nil {
+			return out, err
+		}
+	} else if err := writeBlobAnchor(kept); err != nil {
+		return out, err
+	}
+	// the new anchor holds every referenced blob, pending ones included
+	anchoredCache = exists
+	pendingBlobs = make(map[string]bool)
+	return out, nil
+}
+
+// GC forgets old operations and releases the blobs nothing refers to any
+// more for git gc to remove
+func GC(dryRun bool, expiry time.Duration) error {
+	out, err := gcBlobs(dryRun, expiry)
+	if err != nil {
+		return fmt.Errorf("collecting garbage: %w", err)
+	}
+	emit(out)
+	if dryRun {
+		say("would expire %d operation(s) and release %d unreferenced blob(s), %s loose; %d in use", out.Expired, out.Pruned, formatSize(out.Reclaimable), out.Kept)
+		return nil
+	}
+	say("expired %d operation(s) and released %d unreferenced blob(s), %s loose; %d in use", out.Expired, out.Pruned, formatSize(out.Reclaimable), out.Kept)
+	if out.Pruned > 0 {
+		say("git gc removes them once they are older than gc.pruneExpire")
+	}
+	return nil
+}
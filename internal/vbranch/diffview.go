@@ -0,0 +1,277 @@
+package vbranch
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss/v2"
+	"github.com/tesh254/stick/internal/diff"
+)
+
+var (
+	diffFileStyle   = lipgloss.NewStyle().Bold(true)
+	diffHunkStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	diffInsertStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	diffDeleteStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+)
+
+// fileDiff is the part of a branch's patch that touches one file
+type fileDiff struct {
+	File    string
+	OldFile string // source of a rename or copy
+	Type    string
+	Hunks   []diff.Hunk
+	IDs     []string // hunk IDs, parallel to Hunks
+	Added   int
+	Removed int
+	Binary  *Hunk  // set for a binary change, which has no line hunks
+	OldMode string // mode of a removed file, or before a mode change
+	NewMode string // mode of an added file, or after a mode change
+	ModeID  string // ID of the file's mode change, if the branch holds one
+}
+
+// branchFileDiffs collects a branch's hunks into per-file patches against the base
+func branchFileDiffs(branch *VirtualBranch) ([]fileDiff, error) {
+	files, grouped := hunksByFile(branch)
+	diffs := make([]fileDiff, 0, len(files))
+	for _, filename := range files {
+		hunks := grouped[filename]
+		sort.SliceStable(hunks, func(i, j int) bool {
+			return hunks[i].OldStart < hunks[j].OldStart
+		})
+		fd := fileDiff{File: filename, Type: hunks[0].Type, OldMode: hunks[0].OldMode, NewMode: hunks[0].NewMode}
+		for _, hunk := range hunks {
+			p, err := hunk.patch()
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range p.Lines {
+				switch line.Op {
+				case diff.Insert:
+					fd.Added++
+				case diff.Delete:
+					fd.Removed++
+				}
+			}
+			fd.Hunks = append(fd.Hunks, p)
+			fd.IDs = append(fd.IDs, hunk.ID)
+		}
+		fd.Hunks = diff.Renumber(fd.Hunks)
+		diffs = append(diffs, fd)
+	}
+
+	for _, hunk := range binaryHunks(branch) {
+		diffs = append(diffs, fileDiff{File: hunk.File, Type: hunk.Type, IDs: []string{hunk.ID}, Binary: &hunk, OldMode: hunk.OldMode, NewMode: hunk.NewMode})
+	}
+
+	// a rename is stored as one whole-file hunk; show only what changed
+	for _, hunk := range renameHunks(branch) {
+		if hunk.Binary {
+			diffs = append(diffs, fileDiff{File: hunk.File, OldFile: hunk.OldFile, Type: hunk.Type, IDs: []string{hunk.ID}, Binary: &hunk})
+			continue
+		}
+		p, err := hunk.patch()
+		if err != nil {
+			return nil, err
+		}
+		fd := fileDiff{File: hunk.File, OldFile: hunk.OldFile, Type: hunk.Type}
+		for _, h := range diff.Group(p.Lines, diff.DefaultContext) {
+			for _, line := range h.Lines {
+				switch line.Op {
+				case diff.Insert:
+					fd.Added++
+				case diff.Delete:
+					fd.Removed++
+				}
+			}
+			fd.Hunks = append(fd.Hunks, h)
+			fd.IDs = append(fd.IDs, hunk.ID)
+		}
+		diffs = append(diffs, fd)
+	}
+
+	// a mode change joins the rest of its file's diff, or stands alone
+	for _, hunk := range modeHunks(branch) {
+		i := slices.IndexFunc(diffs, func(fd fileDiff) bool { return fd.File == hunk.File })
+		if i < 0 {
+			diffs = append(diffs, fileDiff{File: hunk.File, Type: hunk.Type})
+			i = len(diffs) - 1
+		}
+		diffs[i].OldMode, diffs[i].NewMode, diffs[i].ModeID = hunk.OldMode, hunk.NewMode, hunk.ID
+		if isTypeChange(hunk.OldMode, hunk.NewMode) && diffs[i].OldFile == "" {
+			split, err := splitTypeChange(branch, diffs[i])
+			if err != nil {
+				return nil, err
+			}
+			diffs = slices.Replace(diffs, i, i+1, split...)
+		}
+	}
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return diffs[i].File < diffs[j].File
+	})
+	return diffs, nil
+}
+
+// isTypeChange reports whether a mode change turns a file into a symlink or back
+func isTypeChange(oldMode, newMode string) bool {
+	return (oldMode == modeSymlink) != (newMode == modeSymlink)
+}
+
+// splitTypeChange shows a file that became a symlink, or stopped being one,
+// as git does: the old file removed and the new one added
+func splitTypeChange(branch *VirtualBranch, fd fileDiff) ([]fileDiff, error) {
+	base, err := getBaseContent(branch, fd.File)
+	if err != nil {
+		return nil, err
+	}
+	lines, failed := diff.Apply(diff.SplitLines(base), fd.Hunks)
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("hunks for %s no longer match their recorded base", fd.File)
+	}
+	removed := fileDiff{File: fd.File, Type: "remove", OldMode: fd.OldMode, Hunks: []diff.Hunk{wholeFileHunk(base, "")}, IDs: []string{fd.ModeID}}
+	added := fileDiff{File: fd.File, Type: "add", NewMode: fd.NewMode, Hunks: []diff.Hunk{wholeFileHunk("", strings.Join(lines, ""))}, IDs: []string{fd.ModeID}}
+	if len(fd.IDs) > 0 {
+		added.IDs = fd.IDs[:1]
+	}
+	removed.Removed = removed.Hunks[0].OldLines
+	added.Added = added.Hunks[0].NewLines
+	return []fileDiff{removed, added}, nil
+}
+
+// name is how the file is listed in a diffstat
+func (fd fileDiff) name() string {
+	if fd.OldFile != "" {
+		return fd.OldFile + " => " + fd.File
+	}
+	return fd.File
+}
+
+// formatPatch renders file diffs as a git-style unified diff, coloring it
+// unless plain is set. Plain patches carry binary changes as git binary
+// patches, so git apply can replay them byte for byte.
+func formatPatch(diffs []fileDiff, plain bool) (string, error) {
+	style := func(s lipgloss.Style, text string) string {
+		if plain {
+			return text
+		}
+		return s.Render(text)
+	}
+
+	var sb strings.Builder
+	for _, fd := range diffs {
+		oldName, newName := "a/"+fd.File, "b/"+fd.File
+		if fd.OldFile != "" {
+			oldName = "a/" + fd.OldFile
+		}
+		header := []string{fmt.Sprintf("diff --git %s %s", oldName, newName)}
+		if fd.ModeID != "" {
+			newMode := "new mode " + fd.NewMode
+			if !plain {
+				newMode += " " + shortHunkID(fd.ModeID)
+			}
+			header = append(header, "old mode "+fd.OldMode, newMode)
+		}
+		switch fd.Type {
+		case "add":
+			header = append(header, "new file mode "+orRegular(fd.NewMode))
+			oldName = "/dev/null"
+		case "remove":
+			header = append(header, "deleted file mode "+orRegular(fd.OldMode))
+			newName = "/dev/null"
+		case "rename", "copy":
+			header = append(header, fd.Type+" from "+fd.OldFile, fd.Type+" to "+fd.File)
+		}
+		if len(fd.Hunks) > 0 {
+			header = append(header, "--- "+oldName, "+++ "+newName)
+		}
+		for _, line := range header {
+			sb.WriteString(style(diffFileStyle, line) + "\n")
+		}
+
+		if fd.Binary != nil {
+			if !plain {
+				sb.WriteString(style(diffHunkStyle, binarySummary(*fd.Binary)+" "+shortHunkID(fd.Binary.ID)) + "\n")
+				continue
+			}
+			binary, err := gitBinaryPatch(*fd.Binary)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(fmt.Sprintf("index %s..%s\n", fullBlobID(fd.Binary.OldBlob), fullBlobID(fd.Binary.NewBlob)) + binary)
+			continue
+		}
+
+		for i, h := range fd.Hunks {
+			header := h.Header()
+			if !plain {
+				header += " " + shortHunkID(fd.IDs[i])
+			}
+			sb.WriteString(style(diffHunkStyle, header) + "\n")
+			sb.WriteString(formatHunkBody(h.Body(), plain))
+		}
+	}
+	return sb.String(), nil
+}
+
+// formatHunkBody colors the added and removed lines of a unified hunk body
+// unless plain is set
+func formatHunkBody(body string, plain bool) string {
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(body, "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		if text == "" {
+			continue
+		}
+		if !plain {
+			switch text[0] {
+			case '+':
+				text = diffInsertStyle.Render(text)
+			case '-':
+				text = diffDeleteStyle.Render(text)
+			}
+		}
+		sb.WriteString(text + "\n")
+	}
+	return sb.String()
+}
+
+// formatStat renders a diffstat summary like git diff --stat
+func formatStat(diffs []fileDiff, plain bool) string {
+	const barWidth = 40
+
+	nameWidth, maxChanges := 0, 0
+	totalAdded, totalRemoved := 0, 0
+	for _, fd := range diffs {
+		nameWidth = max(nameWidth, len(fd.name()))
+		maxChanges = max(maxChanges, fd.Added+fd.Removed)
+		totalAdded += fd.Added
+		totalRemoved += fd.Removed
+	}
+	countWidth := len(fmt.Sprint(maxChanges))
+
+	var sb strings.Builder
+	for _, fd := range diffs {
+		if fd.Binary != nil {
+			fmt.Fprintf(&sb, " %-*s | %s\n", nameWidth, fd.name(), binarySummary(*fd.Binary))
+			continue
+		}
+		if fd.Type == "mode" {
+			fmt.Fprintf(&sb, " %-*s | %s\n", nameWidth, fd.name(), modeSummary(fd.OldMode, fd.NewMode))
+			continue
+		}
+		added, removed := fd.Added, fd.Removed
+		if maxChanges > barWidth {
+			added = (added*barWidth + maxChanges - 1) / maxChanges
+			removed = (removed*barWidth + maxChanges - 1) / maxChanges
+		}
+		plus, minus := strings.Repeat("+", added), strings.Repeat("-", removed)
+		if !plain {
+			plus, minus = diffInsertStyle.Render(plus), diffDeleteStyle.Render(minus)
+		}
+		fmt.Fprintf(&sb, " %-*s | %*d %s%s\n", nameWidth, fd.name(), countWidth, fd.Added+fd.Removed, plus, minus)
+	}
+	fmt.Fprintf(&sb, " %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n", len(diffs), totalAdded, totalRemoved)
+	return sb.String()
+}
@@ -0,0 +1,75 @@
+package vbranch
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NotGitRepoError is returned when stick runs outside a Git repository
+type NotGitRepoError struct{}
+
+func (e *NotGitRepoError) Error() string {
+	return "not a git repository"
+}
+
+// BranchNotFoundError is returned when a reference names no virtual branch
+type BranchNotFoundError struct {
+	Ref string
+}
+
+func (e *BranchNotFoundError) Error() string {
+	return fmt.Sprintf("branch '%s' not found", e.Ref)
+}
+
+// HunkNotFoundError is returned when a reference names no hunk
+type HunkNotFoundError struct {
+	Ref string
+}
+
+func (e *HunkNotFoundError) Error() string {
+	return fmt.Sprintf("hunk '%s' not found", e.Ref)
+}
+
+// ConflictError is returned when hunks could not be applied cleanly. The
+// command's other changes are kept; Conflicts lists what needs attention.
+type ConflictError struct {
+	Message   string
+	Conflicts []HunkConflict
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// DirtyStateError is returned when a command refuses to run because it
+// would lose work, such as unpushed hunks or files edited since an operation
+type DirtyStateError struct {
+	Message string
+}
+
+func (e *DirtyStateError) Error() string {
+	return e.Message
+}
+
+// ErrorKind names the kind of err for scripts: "not_a_git_repository",
+// "branch_not_found", "hunk_not_found", "conflict", "dirty_state" or "error"
+func ErrorKind(err error) string {
+	var notRepo *NotGitRepoError
+	var branchNotFound *BranchNotFoundError
+	var hunkNotFound *HunkNotFoundError
+	var conflict *ConflictError
+	var dirty *DirtyStateError
+	switch {
+	case errors.As(err, &notRepo):
+		return "not_a_git_repository"
+	case errors.As(err, &branchNotFound):
+		return "branch_not_found"
+	case errors.As(err, &hunkNotFound):
+		return "hunk_not_found"
+	case errors.As(err, &conflict):
+		return "conflict"
+	case errors.As(err, &dirty):
+		return "dirty_state"
+	}
+	return "error"
+}
@@ -3,93 +3,261 @@ package vbranch
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/charmbracelet/lipgloss/v2"
 	"github.com/spf13/cobra"
+	"github.com/tesh254/stick/internal/branch"
 	"github.com/tesh254/stick/internal/constants"
+	"github.com/tesh254/stick/internal/stickdir"
 )
 
-func Init() {
+func Init() error {
 	EnsureStateInitialized()
 	if !isGitRepo() {
-		fmt.Println("not a git repository")
-		os.Exit(1)
+		return &NotGitRepoError{}
 	}
 
-	if err := os.MkdirAll(constants.STICK_DIR, 0755); err != nil {
-		fmt.Printf("error creating stick directory: %v\n", err)
-		os.Exit(1)
+	stickDir, err := stickdir.Path()
+	if err != nil {
+		return fmt.Errorf("locating stick directory: %w", err)
+	}
+	if err := os.MkdirAll(stickDir, 0755); err != nil {
+		return fmt.Errorf("creating stick directory: %w", err)
 	}
 
-	// create default virtual branch
-	defaultBranch := &VirtualBranch{
-		Name:      "main-changes",
-		ID:        generateID(),
-		Files:     make(map[string]string),
-		Hunks:     []Hunk{},
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Active:    true,
+	// running init again leaves the existing branches alone
+	if len(state.Branches) > 0 {
+		if current, exists := state.Branches[state.CurrentBranch]; exists {
+			emit(branchOutput(current))
+		}
+		say("stick is already initialized")
+		return nil
 	}
 
+	// create default virtual branch
+	defaultBranch := newVirtualBranch("main-changes")
+
 	state.Branches[defaultBranch.ID] = defaultBranch
 	state.CurrentBranch = defaultBranch.ID
 
-	saveState()
-	fmt.Print(constants.ASCII)
-	fmt.Println("stick initialized successfully!")
-	fmt.Printf("created default virtual branch: %s\n", defaultBranch.Name)
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	if !Structured() {
+		fmt.Print(constants.ASCII)
+	}
+	emit(branchOutput(defaultBranch))
+	say("stick initialized successfully!")
+	say("created default virtual branch: %s", defaultBranch.Name)
+	return nil
 }
 
-func ListBranches() {
+func ListBranches() error {
+	if Structured() {
+		branches := []BranchOutput{}
+		for _, branch := range sortedBranches() {
+			branches = append(branches, branchOutput(branch))
+		}
+		emit(map[string]any{"branches": branches})
+		return nil
+	}
+
 	fmt.Println("virtual branches: ")
 
-	for _, branch := range state.Branches {
-		status := " (active)"
+	for i, branch := range sortedBranches() {
+		status := ""
+		if branch.Active {
+			status = " (active)"
+		}
 		if branch.ID == state.CurrentBranch {
 			status += " *"
 		}
 
-		fmt.Printf("  %s%s - %d hunks\n", branch.Name, status, len(branch.Hunks))
+		fmt.Printf("  %d. %s%s - %d hunks (id %s)\n", i+1, branch.Name, status, len(branch.Hunks), branch.ID)
+	}
+	return nil
+}
+
+// CreateBranch adds a new virtual branch. With from set, the branch starts
+// from a remote branch instead of HEAD and gets a local stick/<name> branch.
+func CreateBranch(name string, from *string, yes bool) error {
+	if err := validateBranchName(name); err != nil {
+		return err
+	}
+
+	var base *branch.Base
+	if from != nil {
+		var err error
+		base, err = branch.CreateVirtualBranch(name, *from, branch.Options{Yes: yes, NoPrompt: Structured(), Say: say})
+		if err != nil {
+			return fmt.Errorf("creating branch %s from %s: %w", name, *from, err)
+		}
+	}
+
+	vb := newVirtualBranch(name)
+	if base != nil {
+		vb.BaseCommit = base.Commit
+		vb.BaseRef = base.Ref()
+		vb.GitBranch = base.GitBranch
+	}
+
+	state.Branches[vb.ID] = vb
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
 	}
+	emit(branchOutput(vb))
+	if base != nil {
+		say("created virtual branch: %s (base %s at %s, git branch: %s)", name, base.Ref(), shortCommit(base.Commit), base.GitBranch)
+		return nil
+	}
+	say("created virtual branch: %s", name)
+	return nil
 }
 
-func CreateBranch(name string) {
-	branch := &VirtualBranch{
-		Name:      name,
-		ID:        generateID(),
-		Files:     make(map[string]string),
-		Hunks:     []Hunk{},
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Active:    true,
+func SwitchBranch(name string, args []string) error {
+	branch, err := resolveBranch(name)
+	if err != nil {
+		return err
 	}
 
-	state.Branches[branch.ID] = branch
-	saveState()
-	fmt.Printf("created virtual branch: %s\n", name)
+	state.CurrentBranch = branch.ID
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(branchOutput(branch))
+	say("switched to virtual branch: %s", branch.Name)
+	return nil
 }
 
-func SwitchBranch(name string, args []string) {
-	for id, branch := range state.Branches {
-		if branch.Name == name {
-			state.CurrentBranch = id
-			saveState()
-			fmt.Printf("switched to virtual branch: %s\n", name)
-			return
+func DeleteBranch(name string, force bool, moveTo string) error {
+	target, err := resolveBranch(name)
+	if err != nil {
+		return err
+	}
+
+	if moveTo != "" {
+		destination, err := resolveBranch(moveTo)
+		if err != nil {
+			return err
+		}
+		if destination.ID == target.ID {
+			return fmt.Errorf("cannot move hunks into the branch being deleted")
+		}
+		if err := mergeBranchInto(target, destination); err != nil {
+			return err
 		}
+		say("moved %d hunk(s) to branch %s", len(target.Hunks), destination.Name)
+	} else if hasUnpushedChanges(target) && !force {
+		return &DirtyStateError{Message: fmt.Sprintf("branch '%s' has %d unpushed hunk(s); push it, move them with --move-to <branch>, or use --force", target.Name, len(target.Hunks))}
+	}
+
+	delete(state.Branches, target.ID)
+	if state.CurrentBranch == target.ID {
+		state.CurrentBranch = ""
+		if remaining := sortedBranches(); len(remaining) > 0 {
+			state.CurrentBranch = remaining[0].ID
+		}
+	}
+
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	say("deleted virtual branch: %s", target.Name)
+	if moveTo == "" && target.Active && len(target.Hunks) > 0 {
+		say("its changes are still in the working directory")
+	}
+	return nil
+}
+
+func RenameBranch(oldName string, newName string) error {
+	target, err := resolveBranch(oldName)
+	if err != nil {
+		return err
+	}
+	if err := validateBranchName(newName); err != nil {
+		return err
+	}
+
+	oldName = target.Name
+	target.Name = newName
+	target.UpdatedAt = time.Now()
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
 	}
-	fmt.Printf("branch '%s' not found\n", name)
+	emit(branchOutput(target))
+	say("renamed virtual branch %s to %s", oldName, newName)
+	return nil
 }
 
-func Status() {
+func DescribeBranch(targetBranchName *string, message *string) error {
+	target, err := resolveBranchOrCurrent(targetBranchName)
+	if err != nil {
+		return err
+	}
+
+	description := ""
+	if message != nil {
+		description = strings.TrimSpace(*message)
+	} else {
+		initial := target.Description + "\n\n" +
+			fmt.Sprintf("# Describe virtual branch '%s'. The description is used as the\n", target.Name) +
+			"# commit message when it is pushed. Lines starting with '#' are ignored.\n"
+		edited, err := editText(initial)
+		if err != nil {
+			return fmt.Errorf("editing description: %w", err)
+		}
+		description = edited
+	}
+
+	target.Description = description
+	target.UpdatedAt = time.Now()
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(branchOutput(target))
+	if description == "" {
+		say("cleared description of virtual branch %s", target.Name)
+		return nil
+	}
+	say("updated description of virtual branch %s", target.Name)
+	return nil
+}
+
+func Status() error {
+	gitStatus, err := getGitStatus()
+	if err != nil {
+		return err
+	}
+	if Structured() {
+		status := StatusOutput{
+			GitRoot:     state.GitRoot,
+			GitBranch:   getCurrentBranchName(),
+			Uncommitted: []string{},
+			Changes:     []StatusEntryOutput{},
+			Branches:    []BranchOutput{},
+		}
+		for _, entry := range gitStatus {
+			status.Uncommitted = append(status.Uncommitted, entry.String())
+			status.Changes = append(status.Changes, statusEntryOutput(entry))
+		}
+		for _, branch := range sortedBranches() {
+			out := branchOutput(branch)
+			out.Stale, _ = branchStaleness(branch)
+			status.Branches = append(status.Branches, out)
+		}
+		emit(status)
+		return nil
+	}
+
 	fmt.Println("stick Status:")
 	fmt.Printf("git Root: %s\n", state.GitRoot)
 	fmt.Printf("current branch: %s\n", getCurrentBranchName())
 	fmt.Println()
 
 	// Show Git status
-	gitStatus := getGitStatus()
 	if len(gitStatus) > 0 {
 		fmt.Println("uncommitted changes:")
 		for _, file := range gitStatus {
@@ -100,7 +268,7 @@ func Status() {
 
 	// Show virtual branches
 	fmt.Println("virtual branches:")
-	for _, branch := range state.Branches {
+	for _, branch := range sortedBranches() {
 		status := ""
 		if branch.Active {
 			status = " (active)"
@@ -111,163 +279,463 @@ func Status() {
 		fmt.Printf("  %s%s:\n", branch.Name, status)
 		fmt.Printf("    files: %d\n", len(branch.Files))
 		fmt.Printf("    hunks: %d\n", len(branch.Hunks))
+		for _, hunk := range branch.Hunks {
+			switch {
+			case hunk.Binary:
+				fmt.Printf("    %s: %s\n", hunk.File, binarySummary(hunk))
+			case hunk.isMode():
+				fmt.Printf("    %s: %s\n", hunk.File, modeSummary(hunk.OldMode, hunk.NewMode))
+			}
+		}
+		if conflicted := conflictedHunks(branch); len(conflicted) > 0 {
+			fmt.Printf("    conflicting: %d hunk(s) need resolving after rebase\n", len(conflicted))
+		}
+		if branch.BaseRef != "" {
+			fmt.Printf("    base: %s (%s)\n", shortCommit(branch.BaseCommit), branch.BaseRef)
+		} else if branch.BaseCommit != "" {
+			fmt.Printf("    base: %s\n", shortCommit(branch.BaseCommit))
+		}
+		if stale, err := branchStaleness(branch); err == nil && stale != nil {
+			if stale.Diverged {
+				fmt.Printf("    stale: base %s is not an ancestor of HEAD\n", shortCommit(branch.BaseCommit))
+			} else {
+				fmt.Printf("    stale: base is %d commit(s) behind HEAD, %d touch its files\n", stale.Behind, stale.Touching)
+			}
+			if len(stale.ChangedFiles) > 0 {
+				fmt.Printf("    changed upstream: %s\n", strings.Join(stale.ChangedFiles, ", "))
+			}
+		}
 		fmt.Printf("    updated: %s\n", branch.UpdatedAt.Format("2006-01-02 15:04:05"))
 		fmt.Println()
 	}
+	return nil
 }
 
-func AddFile(cmd *cobra.Command, args []string) {
-	if state.CurrentBranch == "" {
-		fmt.Println("no current virtual branch. Use 'stick branch create' first.")
-		return
+func AddFile(cmd *cobra.Command, args []string) error {
+	if _, exists := state.Branches[state.CurrentBranch]; !exists {
+		return fmt.Errorf("no current virtual branch. Use 'stick branch create' first")
+	}
+	if threshold, err := cmd.Flags().GetInt("find-renames"); err == nil {
+		if err := setRenameThreshold(threshold); err != nil {
+			return err
+		}
+	}
+	patch, _ := cmd.Flags().GetBool("patch")
+	staged, _ := cmd.Flags().GetBool("staged")
+	if patch && staged {
+		return fmt.Errorf("--staged and --patch cannot be used together")
 	}
 	all, _ := cmd.Flags().GetBool("all")
-	if all || len(args) == 0 || (len(args) == 1 && args[0] == ".") {
-		AddAll()
-	} else {
-		branch := state.Branches[state.CurrentBranch]
-		for _, file := range args {
-			if err := addFileToVirtualBranch(branch, file); err != nil {
-				fmt.Printf("error adding %s: %v\n", file, err)
-			} else {
-				fmt.Printf("added %s to virtual branch %s\n", file, branch.Name)
-			}
+	if !staged && !patch && (all || len(args) == 0 || (len(args) == 1 && args[0] == ".")) {
+		return AddAll()
+	}
+	paths, err := toRepoPaths(args)
+	if err != nil {
+		return err
+	}
+	if staged {
+		return AddStaged(paths)
+	}
+	if patch {
+		return AddPatch(paths)
+	}
+
+	changed, err := changedPaths()
+	if err != nil {
+		return err
+	}
+	paths = expandPaths(paths, changed)
+	failed, err := addFiles(state.Branches[state.CurrentBranch], paths, addFileToVirtualBranch, "added %s to virtual branch %s")
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d file(s) could not be added", failed, len(paths))
+	}
+	return nil
+}
+
+func MoveHunkToTargetBranch(hunkID string, targetBranchName string) error {
+	targetBranch, err := resolveBranch(targetBranchName)
+	if err != nil {
+		return err
+	}
+	targetBranchName = targetBranch.Name
+
+	sourceBranch, index, err := resolveHunk(hunkID)
+	if err != nil {
+		return err
+	}
+	hunk := sourceBranch.Hunks[index]
+	if sourceBranch.ID == targetBranch.ID {
+		say("hunk %s is already in branch %s", shortHunkID(hunk.ID), targetBranchName)
+		return nil
+	}
+
+	if err := moveHunk(sourceBranch, index, targetBranch); err != nil {
+		return fmt.Errorf("moving hunk: %w", err)
+	}
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+
+	emit(branchOutput(targetBranch))
+	say("moved hunk %s to branch %s", shortHunkID(hunk.ID), targetBranchName)
+	return nil
+}
+
+func PushBranchToRemoteAsGitBranch(targetBranchName *string) error {
+	targetBranch, err := resolveBranchOrCurrent(targetBranchName)
+	if err != nil {
+		return err
+	}
+	branchName := targetBranch.Name
+
+	if err := pushVirtualBranch(targetBranch, progressWriter()); err != nil {
+		return fmt.Errorf("pushing branch: %w", err)
+	}
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(branchOutput(targetBranch))
+	say("successfully pushed virtual branch '%s' to remote", branchName)
+	return nil
+}
+
+func ApplyVBranchChangesToWorkingDir(targetBranchName *string) error {
+	targetBranch, err := resolveBranchOrCurrent(targetBranchName)
+	if err != nil {
+		return err
+	}
+	branchName := targetBranch.Name
+
+	conflicts, err := applyVirtualBranch(targetBranch)
+	if err != nil {
+		return fmt.Errorf("applying branch: %w", err)
+	}
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(ConflictsOutput{Branch: branchName, Conflicts: append([]HunkConflict{}, conflicts...)})
+
+	if len(conflicts) > 0 {
+		say("applied virtual branch '%s' with %d conflicting hunk(s):", branchName, len(conflicts))
+		for _, c := range conflicts {
+			say("  %s %s:%d-%d (kept working tree version)", shortHunkID(c.HunkID), c.File, c.StartLine, c.EndLine)
 		}
-		branch.UpdatedAt = time.Now()
-		saveState()
+		return &ConflictError{Message: fmt.Sprintf("%d hunk(s) of '%s' conflict with the working tree", len(conflicts), branchName), Conflicts: conflicts}
 	}
+	say("applied virtual branch '%s' to working directory", branchName)
+	return nil
 }
 
-func MoveHunkToTargetBranch(hunkID string, targetBranchName string) {
-	var targetBranch *VirtualBranch
-	for _, branch := range state.Branches {
-		if branch.Name == targetBranchName {
-			targetBranch = branch
-			break
+func UnapplyVBranchChangesToWorkingDir(targetBranchName *string) error {
+	targetBranch, err := resolveBranchOrCurrent(targetBranchName)
+	if err != nil {
+		return err
+	}
+	branchName := targetBranch.Name
+
+	conflicts, err := unapplyVirtualBranch(targetBranch)
+	if err != nil {
+		return fmt.Errorf("unapplying branch: %w", err)
+	}
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(ConflictsOutput{Branch: branchName, Conflicts: append([]HunkConflict{}, conflicts...)})
+
+	if len(conflicts) > 0 {
+		say("unapplied virtual branch '%s' with %d conflicting hunk(s):", branchName, len(conflicts))
+		for _, c := range conflicts {
+			say("  %s %s:%d-%d (left in working tree)", shortHunkID(c.HunkID), c.File, c.StartLine, c.EndLine)
 		}
+		return &ConflictError{Message: fmt.Sprintf("%d hunk(s) of '%s' conflict with the working tree", len(conflicts), branchName), Conflicts: conflicts}
 	}
+	say("unapplied virtual branch '%s' from working directory", branchName)
+	return nil
+}
 
-	if targetBranch == nil {
-		fmt.Printf("target branch '%s' not found\n", targetBranchName)
-		return
+func SyncBranchesWithGitRepoState() error {
+	say("syncing with Git repository...")
+
+	// Update state from current Git status
+	if err := syncWithGit(); err != nil {
+		return fmt.Errorf("syncing: %w", err)
 	}
 
-	// Find and move the hunk
-	for _, sourceBranch := range state.Branches {
-		for i, hunk := range sourceBranch.Hunks {
-			if hunk.ID == hunkID {
-				// Remove from source
-				sourceBranch.Hunks = append(sourceBranch.Hunks[:i], sourceBranch.Hunks[i+1:]...)
-				// Add to target
-				targetBranch.Hunks = append(targetBranch.Hunks, hunk)
+	state.LastSync = time.Now()
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	say("sync completed successfully!")
+	return nil
+}
 
-				sourceBranch.UpdatedAt = time.Now()
-				targetBranch.UpdatedAt = time.Now()
-				saveState()
+// RebaseBranches carries the named branches, or every branch when none are
+// given, onto the commit onto names
+func RebaseBranches(onto string, names []string) error {
+	commit, err := resolveCommit(onto)
+	if err != nil {
+		return err
+	}
 
-				fmt.Printf("moved hunk %s to branch %s\n", hunkID, targetBranchName)
-				return
+	branches := sortedBranches()
+	if len(names) > 0 {
+		branches = nil
+		for _, name := range names {
+			branch, err := resolveBranch(name)
+			if err != nil {
+				return err
 			}
+			branches = append(branches, branch)
 		}
 	}
 
-	fmt.Printf("hunk '%s' not found\n", hunkID)
-}
+	conflicted := 0
+	results := []RebaseOutput{}
+	for _, branch := range branches {
+		if branch.BaseCommit == commit {
+			say("virtual branch '%s' is already based on %s", branch.Name, shortCommit(commit))
+			results = append(results, RebaseOutput{Branch: branch.Name, Onto: commit, Skipped: true, Upstream: []string{}, Conflicts: []HunkConflict{}})
+			continue
+		}
+		result, err := rebaseBranch(branch, commit)
+		if err != nil {
+			return fmt.Errorf("rebasing branch '%s': %w", branch.Name, err)
+		}
+		say("rebased virtual branch '%s' onto %s: %d clean, %d conflicting", branch.Name, shortCommit(commit), result.Clean, len(result.Conflicts))
+		for _, file := range result.Upstream {
+			say("  %s: changes already upstream", file)
+		}
+		for _, c := range result.Conflicts {
+			say("  %s %s:%d-%d conflicts with upstream changes", shortHunkID(c.HunkID), c.File, c.StartLine, c.EndLine)
+		}
+		conflicted += len(result.Conflicts)
+		results = append(results, RebaseOutput{
+			Branch:    branch.Name,
+			Onto:      commit,
+			Clean:     result.Clean,
+			Upstream:  append([]string{}, result.Upstream...),
+			Conflicts: append([]HunkConflict{}, result.Conflicts...),
+		})
+	}
 
-func PushBranchToRemoteAsGitBranch(targetBranchName *string) {
-	branchName := ""
-	if targetBranchName != nil {
-		branchName = *targetBranchName
-	} else {
-		branchName = getCurrentBranchName()
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(map[string]any{"branches": results})
+	if conflicted > 0 {
+		say("fix the conflicting files in the working tree, then 'stick add' them to the branch to resolve")
+		return &ConflictError{Message: fmt.Sprintf("%d hunk(s) conflict with %s", conflicted, shortCommit(commit))}
 	}
+	return nil
+}
 
-	var targetBranch *VirtualBranch
-	for _, branch := range state.Branches {
-		if branch.Name == branchName {
-			targetBranch = branch
-			break
-		}
+func Undo(force bool) error {
+	ops, err := readOplog()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
+	}
+	head, err := readOplogHead()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
 	}
 
-	if targetBranch == nil {
-		fmt.Printf("branch '%s' not found\n", branchName)
-		return
+	op := findOperation(ops, head)
+	if op == nil {
+		say("nothing to undo")
+		return nil
 	}
 
-	if err := pushVirtualBranch(targetBranch); err != nil {
-		fmt.Printf("error pushing branch: %v\n", err)
-	} else {
-		fmt.Printf("successfully pushed virtual branch '%s' to remote\n", branchName)
+	if err := restoreOperationPoint(op.Before, op.before(), op.after(), force); err != nil {
+		return fmt.Errorf("undoing '%s': %w", op.Command, err)
+	}
+	if err := writeOplogHead(op.Parent); err != nil {
+		return fmt.Errorf("updating operation log: %w", err)
 	}
+	say("undid %s: %s", op.ID, op.Command)
+	return nil
 }
 
-func ApplyVBranchChangesToWorkingDir(targetBranchName *string) {
-	branchName := ""
-	if targetBranchName != nil {
-		branchName = *targetBranchName
-	} else {
-		branchName = getCurrentBranchName()
+func Redo(force bool) error {
+	ops, err := readOplog()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
+	}
+	head, err := readOplogHead()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
 	}
 
-	var targetBranch *VirtualBranch
-	for _, branch := range state.Branches {
-		if branch.Name == branchName {
-			targetBranch = branch
+	// the most recent operation made on top of the current point
+	var next *Operation
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].Parent == head && ops[i].ID != head {
+			next = &ops[i]
 			break
 		}
 	}
-
-	if targetBranch == nil {
-		fmt.Printf("branch '%s' not found\n", branchName)
-		return
+	if next == nil {
+		say("nothing to redo")
+		return nil
 	}
 
-	if err := applyVirtualBranch(targetBranch); err != nil {
-		fmt.Printf("error applying branch: %v\n", err)
-	} else {
-		fmt.Printf("applied virtual branch '%s' to working directory\n", branchName)
+	if err := restoreOperationPoint(next.After, next.after(), next.before(), force); err != nil {
+		return fmt.Errorf("redoing '%s': %w", next.Command, err)
+	}
+	if err := writeOplogHead(next.ID); err != nil {
+		return fmt.Errorf("updating operation log: %w", err)
 	}
+	say("redid %s: %s", next.ID, next.Command)
+	return nil
 }
 
-func UnapplyVBranchChangesToWorkingDir(targetBranchName *string) {
-	branchName := ""
-	if targetBranchName != nil {
-		branchName = *targetBranchName
-	} else {
-		branchName = getCurrentBranchName()
+func ShowOplog() error {
+	ops, err := readOplog()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
+	}
+	head, _ := readOplogHead()
+	if Structured() {
+		operations := []OperationOutput{}
+		for i := len(ops) - 1; i >= 0; i-- {
+			op := ops[i]
+			files := []string{}
+			for filename := range op.AfterFiles {
+				files = append(files, filename)
+			}
+			sort.Strings(files)
+			operations = append(operations, OperationOutput{
+				ID:        op.ID,
+				Parent:    op.Parent,
+				Command:   op.Command,
+				CreatedAt: op.CreatedAt,
+				Files:     files,
+				Head:      op.ID == head,
+			})
+		}
+		emit(map[string]any{"operations": operations})
+		return nil
+	}
+	if len(ops) == 0 {
+		fmt.Println("operation log is empty")
+		return nil
 	}
 
-	var targetBranch *VirtualBranch
-	for _, branch := range state.Branches {
-		if branch.Name == branchName {
-			targetBranch = branch
-			break
+	fmt.Println("operations (newest first):")
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		marker := " "
+		if op.ID == head {
+			marker = "*"
 		}
+		fmt.Printf("%s %s  %s  %s (%d files)\n", marker, op.ID, op.CreatedAt.Format("2006-01-02 15:04:05"), op.Command, len(op.AfterFiles))
 	}
+	return nil
+}
 
-	if targetBranch == nil {
-		fmt.Printf("branch '%s' not found\n", branchName)
-		return
+func RestoreOperation(id string, force bool) error {
+	ops, err := readOplog()
+	if err != nil {
+		return fmt.Errorf("reading operation log: %w", err)
+	}
+	op := findOperation(ops, id)
+	if op == nil {
+		return fmt.Errorf("operation '%s' not found", id)
 	}
 
-	if err := unapplyVirtualBranch(targetBranch); err != nil {
-		fmt.Printf("error unapplying branch: %v\n", err)
-	} else {
-		fmt.Printf("unapplied virtual branch '%s' from working directory\n", branchName)
+	// the working tree is expected to match the current point
+	var expected fileSnapshot
+	head, _ := readOplogHead()
+	if current := findOperation(ops, head); current != nil {
+		expected = current.after()
 	}
+
+	if err := restoreOperationPoint(op.After, op.after(), expected, force); err != nil {
+		return fmt.Errorf("restoring operation %s: %w", id, err)
+	}
+	if err := writeOplogHead(op.ID); err != nil {
+		return fmt.Errorf("updating operation log: %w", err)
+	}
+	say("restored state after %s: %s", op.ID, op.Command)
+	return nil
 }
 
-func SyncBranchesWithGitRepoState() {
-	fmt.Println("syncing with Git repository...")
+func ShowDiff(targetBranchName *string, stat bool, nameOnly bool, patch bool) error {
+	targetBranch, err := resolveBranchOrCurrent(targetBranchName)
+	if err != nil {
+		return err
+	}
+	branchName := targetBranch.Name
 
-	// Update state from current Git status
-	if err := syncWithGit(); err != nil {
-		fmt.Printf("error syncing: %v\n", err)
-		return
+	diffs, err := branchFileDiffs(targetBranch)
+	if err != nil {
+		return fmt.Errorf("building diff: %w", err)
+	}
+	if Structured() {
+		out := DiffOutput{Branch: branchName, Files: []DiffFileOutput{}, Conflicted: []HunkOutput{}}
+		for _, fd := range diffs {
+			file := DiffFileOutput{File: fd.File, OldFile: fd.OldFile, Type: fd.Type, OldMode: fd.OldMode, NewMode: fd.NewMode, Added: fd.Added, Removed: fd.Removed, Hunks: []HunkOutput{}}
+			if fd.Binary != nil {
+				file.Binary = true
+				file.OldSize = blobSize(fd.Binary.OldBlob)
+				file.NewSize = blobSize(fd.Binary.NewBlob)
+				file.Hunks = append(file.Hunks, hunkOutput(*fd.Binary))
+			}
+			if fd.ModeID != "" {
+				file.Hunks = append(file.Hunks, HunkOutput{ID: fd.ModeID, File: fd.File, Type: "mode", OldMode: fd.OldMode, NewMode: fd.NewMode})
+			}
+			for i, h := range fd.Hunks {
+				file.Hunks = append(file.Hunks, HunkOutput{
+					ID:       fd.IDs[i],
+					File:     fd.File,
+					OldFile:  fd.OldFile,
+					Type:     fd.Type,
+					OldStart: h.OldStart,
+					OldLines: h.OldLines,
+					NewStart: h.NewStart,
+					NewLines: h.NewLines,
+					Content:  h.Body(),
+				})
+			}
+			out.Files = append(out.Files, file)
+		}
+		for _, hunk := range conflictedHunks(targetBranch) {
+			out.Conflicted = append(out.Conflicted, hunkOutput(hunk))
+		}
+		emit(out)
+		return nil
+	}
+	if !patch {
+		for _, hunk := range conflictedHunks(targetBranch) {
+			say("conflicting hunk %s in %s is left out until resolved", shortHunkID(hunk.ID), hunk.File)
+		}
+	}
+	if len(diffs) == 0 {
+		if !patch {
+			say("virtual branch '%s' has no changes", branchName)
+		}
+		return nil
 	}
 
-	state.LastSync = time.Now()
-	saveState()
-	fmt.Println("sync completed successfully!")
+	switch {
+	case nameOnly:
+		for _, fd := range diffs {
+			fmt.Println(fd.File)
+		}
+	case stat:
+		lipgloss.Print(formatStat(diffs, patch))
+	default:
+		text, err := formatPatch(diffs, patch)
+		if err != nil {
+			return fmt.Errorf("building diff: %w", err)
+		}
+		if patch {
+			fmt.Print(text)
+		} else {
+			lipgloss.Print(text)
+		}
+	}
+	return nil
 }
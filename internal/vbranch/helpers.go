@@ -1,12 +1,20 @@
 package vbranch
 
 import (
-	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tesh254/stick/internal/diff"
 )
 
 func getCurrentDir() string {
@@ -23,28 +31,59 @@ func getGitRoot() string {
 	return strings.TrimSpace(string(output))
 }
 
-func isGitRepo() bool {
-	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
-	err := cmd.Run()
-	return err == nil
+// gitCommand prepares a git command that runs from the repository root, so
+// paths in its arguments and output are relative to the root
+func gitCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	if state != nil {
+		cmd.Dir = state.GitRoot
+	}
+	return cmd
 }
 
-func getGitStatus() []string {
-	cmd := exec.Command("git", "status", "--porcelain")
-	output, err := cmd.Output()
+// worktreePath returns the on-disk location of a repository-relative path
+func worktreePath(filename string) string {
+	return filepath.Join(state.GitRoot, filepath.FromSlash(filename))
+}
+
+// toRepoPath converts a path given on the command line, relative to the
+// current directory, into a path relative to the repository root
+func toRepoPath(arg string) (string, error) {
+	abs, err := filepath.Abs(arg)
 	if err != nil {
-		return []string{}
+		return "", err
+	}
+	root := state.GitRoot
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(resolved, filepath.Base(abs))
 	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside repository at %s", arg, state.GitRoot)
+	}
+	return filepath.ToSlash(rel), nil
+}
 
-	var files []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 3 {
-			files = append(files, line)
+// toRepoPaths converts each of args with toRepoPath
+func toRepoPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		path, err := toRepoPath(arg)
+		if err != nil {
+			return nil, fmt.Errorf("adding %s: %w", arg, err)
 		}
+		paths = append(paths, path)
 	}
-	return files
+	return paths, nil
+}
+
+func isGitRepo() bool {
+	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
+	err := cmd.Run()
+	return err == nil
 }
 
 func getCurrentBranchName() string {
@@ -54,71 +93,628 @@ func getCurrentBranchName() string {
 	return ""
 }
 
+// hunkID derives a hunk's ID from its file and diff, so recording the same
+// change again yields the same ID. taken holds IDs already handed out for
+// other hunks, which a repeated identical change is steered away from.
+func hunkID(filename, content string, taken map[string]bool) string {
+	sum := sha1.Sum([]byte(filename + "\x00" + content))
+	id := hex.EncodeToString(sum[:])
+	for n := 2; taken[id]; n++ {
+		sum = sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d", filename, content, n)))
+		id = hex.EncodeToString(sum[:])
+	}
+	return id
+}
+
 func generateID() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
-func pushVirtualBranch(branch *VirtualBranch) error {
-	cmd := exec.Command("git", "checkout", "-b", branch.Name)
-	if err := cmd.Run(); err != nil {
-		return err
+// newVirtualBranch returns an empty, active branch called name
+func newVirtualBranch(name string) *VirtualBranch {
+	return &VirtualBranch{
+		Name:      name,
+		ID:        generateID(),
+		Files:     make(map[string]string),
+		BaseBlobs: make(map[string]string),
+		Hunks:     []Hunk{},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Active:    true,
 	}
+}
 
-	for filename, content := range branch.Files {
-		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
-			return err
+// runGit runs a git command with extra environment and stdin, returning its trimmed output
+func runGit(env []string, stdin string, args ...string) (string, error) {
+	cmd := gitCommand(args...)
+	cmd.Env = append(os.Environ(), env...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(exitError.Stderr)))
 		}
+		return "", err
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	cmd = exec.Command("git", "add", "-A") // Stage all changes, including deletions
-	if err := cmd.Run(); err != nil {
-		return err
+// treeBlob returns the mode and blob of filename in commit; a missing file
+// has blob "" and the mode of a regular file
+func treeBlob(commit, filename string) (string, string) {
+	entry, _ := runGit(nil, "", "ls-tree", "--full-tree", commit, "--", filename)
+	if entry == "" {
+		return "100644", ""
+	}
+	fields := strings.Fields(entry)
+	return fields[0], fields[2]
+}
+
+// treeEntry returns the mode and content of filename in commit, and whether
+// it is there; a missing file reads as an empty regular file
+func treeEntry(commit, filename string) (string, string, bool, error) {
+	mode, blob := treeBlob(commit, filename)
+	if blob == "" {
+		return mode, "", false, nil
+	}
+	content, err := getBlobContent(blob)
+	if err != nil {
+		return "", "", false, err
+	}
+	return mode, content, true, nil
+}
+
+// buildBranchCommit writes a commit holding exactly the branch's hunks on
+// top of base
+func buildBranchCommit(branch *VirtualBranch, base, parent string) (string, error) {
+	tree, err := buildBranchTree(branch, base)
+	if err != nil {
+		return "", err
+	}
+
+	// pushing again without new changes reuses the previous commit
+	if parentTree, _ := runGit(nil, "", "rev-parse", parent+"^{tree}"); parentTree == tree {
+		return parent, nil
 	}
 
 	commitMsg := fmt.Sprintf("Virtual branch: %s", branch.Name)
 	if branch.Description != "" {
 		commitMsg = branch.Description
 	}
-	cmd = exec.Command("git", "commit", "-m", commitMsg)
+	return runGit(nil, commitMsg, "commit-tree", tree, "-p", parent)
+}
+
+// buildBranchTree writes the tree of base with the branch's hunks applied,
+// using a throwaway index so the real one is never touched
+func buildBranchTree(branch *VirtualBranch, base string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "stick-index-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(tmpDir, "index")}
+
+	if _, err := runGit(env, "", "read-tree", base); err != nil {
+		return "", err
+	}
+	if err := stageBranch(branch, base, env); err != nil {
+		return "", err
+	}
+	return runGit(env, "", "write-tree")
+}
+
+// stageBranch writes the branch's version of each file it touches, its
+// hunks applied to base, into the index env points at. Entries for other
+// files are left as they are.
+func stageBranch(branch *VirtualBranch, base string, env []string) error {
+	files, grouped := hunksByFile(branch)
+	for _, filename := range files {
+		hunks := grouped[filename]
+
+		patches := make([]diff.Hunk, 0, len(hunks))
+		for _, hunk := range hunks {
+			p, err := hunk.patch()
+			if err != nil {
+				return err
+			}
+			patches = append(patches, p)
+		}
+
+		mode, baseContent, exists, err := treeEntry(base, filename)
+		if err != nil {
+			return err
+		}
+		if !exists && hunks[0].NewMode != "" {
+			mode = hunks[0].NewMode
+		}
+
+		result, failed := diff.Apply(diff.SplitLines(baseContent), patches)
+		if len(failed) > 0 {
+			return fmt.Errorf("hunks for %s do not apply to %s", filename, base)
+		}
+		content := strings.Join(result, "")
+
+		if content == "" && hunks[0].Type == "remove" {
+			if _, err := runGit(env, "", "update-index", "--force-remove", "--", filename); err != nil {
+				return err
+			}
+			continue
+		}
+
+		blob, err := runGit(nil, content, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return err
+		}
+		if _, err := runGit(env, "", "update-index", "--add", "--cacheinfo", mode+","+blob+","+filename); err != nil {
+			return err
+		}
+	}
+
+	// binary hunks swap whole blobs, so the base must hold the old one
+	for _, hunk := range binaryHunks(branch) {
+		mode, blob := treeBlob(base, hunk.File)
+		if blob == hunk.NewBlob {
+			continue // already there
+		}
+		if blob != hunk.OldBlob {
+			return fmt.Errorf("binary file %s changed in %s since it was recorded", hunk.File, base)
+		}
+		if blob == "" && hunk.NewMode != "" {
+			mode = hunk.NewMode
+		}
+		args := []string{"update-index", "--force-remove", "--", hunk.File}
+		if hunk.NewBlob != "" {
+			args = []string{"update-index", "--add", "--cacheinfo", mode + "," + hunk.NewBlob + "," + hunk.File}
+		}
+		if _, err := runGit(env, "", args...); err != nil {
+			return err
+		}
+	}
+
+	// a rename takes its source's mode and content, edited, to the new path
+	for _, hunk := range renameHunks(branch) {
+		_, destBlob := treeBlob(base, hunk.File)
+		if destBlob != "" && destBlob == branch.Files[hunk.File] && (hunk.Type == "copy" || getBlobAt(base, hunk.OldFile) == "") {
+			continue // already there
+		}
+		if hunk.Binary {
+			mode, blob := treeBlob(base, hunk.OldFile)
+			if blob != hunk.OldBlob {
+				return fmt.Errorf("binary file %s changed in %s since it was recorded", hunk.OldFile, base)
+			}
+			if _, err := runGit(env, "", "update-index", "--add", "--cacheinfo", mode+","+hunk.NewBlob+","+hunk.File); err != nil {
+				return err
+			}
+			if hunk.Type == "rename" {
+				if _, err := runGit(env, "", "update-index", "--force-remove", "--", hunk.OldFile); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		p, err := hunk.patch()
+		if err != nil {
+			return err
+		}
+		mode, sourceContent, exists, err := treeEntry(base, hunk.OldFile)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("cannot %s %s: it is not in %s", hunk.Type, hunk.OldFile, base)
+		}
+		result, failed := diff.Apply(diff.SplitLines(sourceContent), []diff.Hunk{p})
+		if len(failed) > 0 {
+			return fmt.Errorf("the %s of %s does not apply to %s", hunk.Type, hunk.OldFile, base)
+		}
+		blob, err := runGit(nil, strings.Join(result, ""), "hash-object", "-w", "--stdin")
+		if err != nil {
+			return err
+		}
+		if _, err := runGit(env, "", "update-index", "--add", "--cacheinfo", mode+","+blob+","+hunk.File); err != nil {
+			return err
+		}
+		if hunk.Type == "rename" {
+			if _, err := runGit(env, "", "update-index", "--force-remove", "--", hunk.OldFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	// mode changes apply to whatever content the file ended up with
+	for _, hunk := range modeHunks(branch) {
+		entry, err := runGit(env, "", "ls-files", "--stage", "--", hunk.File)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			return fmt.Errorf("cannot change the mode of %s: it is not in %s", hunk.File, base)
+		}
+		if fields[0] != hunk.OldMode && fields[0] != hunk.NewMode {
+			return fmt.Errorf("the mode of %s changed in %s since it was recorded", hunk.File, base)
+		}
+		if _, err := runGit(env, "", "update-index", "--cacheinfo", hunk.NewMode+","+fields[1]+","+hunk.File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushVirtualBranch commits the branch's hunks to its Git branch, or
+// refs/heads/<name> when it has none, and pushes that ref, leaving HEAD,
+// the index and the working tree alone. git's push output goes to out.
+func pushVirtualBranch(branch *VirtualBranch, out io.Writer) error {
+	gitBranch := branch.GitBranch
+	if gitBranch == "" {
+		gitBranch = branch.Name
+	}
+	refName := "refs/heads/" + gitBranch
+
+	if conflicted := conflictedHunks(branch); len(conflicted) > 0 {
+		return &ConflictError{Message: fmt.Sprintf("branch '%s' has %d conflicting hunk(s) from a rebase; resolve them and 'stick add' the files first", branch.Name, len(conflicted))}
+	}
+
+	if checkedOut, _ := runGit(nil, "", "symbolic-ref", "--quiet", "HEAD"); checkedOut == refName {
+		return fmt.Errorf("git branch '%s' is checked out; switch away from it before pushing", gitBranch)
+	}
+
+	base := branch.BaseCommit
+	if base == "" {
+		head, err := getHeadCommit()
+		if err != nil {
+			return err
+		}
+		base = head
+	}
+
+	// an earlier push of this branch is replaced, fast-forwarding when it
+	// still sits on base; commits someone else made on the Git branch are
+	// kept and the hunks applied on top of them
+	parent, treeBase := base, base
+	previous, _ := runGit(nil, "", "rev-parse", "--verify", "--quiet", refName)
+	pushedBase := branch.PushedBase
+	if pushedBase == "" {
+		pushedBase = base
+	}
+	switch {
+	case previous == "" || previous == base:
+	case previous == branch.PushedCommit && isAncestor(pushedBase, base):
+		// base already holds everything the last push was built on
+		if isAncestor(base, previous) {
+			parent = previous
+		}
+	case previous == branch.PushedCommit && isAncestor(base, pushedBase):
+		parent, treeBase = previous, pushedBase
+	case previous != branch.PushedCommit && isAncestor(base, previous):
+		parent, treeBase = previous, previous
+	default:
+		return fmt.Errorf("git branch '%s' already exists and is not based on %s; rename the virtual branch or delete the git branch first", gitBranch, shortCommit(base))
+	}
+
+	commit, err := buildBranchCommit(branch, treeBase, parent)
+	if err != nil {
+		return err
+	}
+
+	// the expected old value stops a branch updated meanwhile from being overwritten
+	if commit != previous {
+		if _, err := runGit(nil, "", "update-ref", "-m", "stick push", refName, commit, previous); err != nil {
+			return err
+		}
+	}
+
+	cmd := gitCommand("push", "-u", "origin", refName+":"+refName)
+	cmd.Stdout = out
+	cmd.Stderr = out
 	if err := cmd.Run(); err != nil {
 		return err
 	}
 
-	cmd = exec.Command("git", "push", "-u", "origin", branch.Name)
-	return cmd.Run()
+	branch.PushedCommit = commit
+	branch.PushedBase = treeBase
+	branch.PushedAt = time.Now()
+	return nil
 }
 
-func applyVirtualBranch(branch *VirtualBranch) error {
-	for filename, content := range branch.Files {
-		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
-			return err
+// hasUnpushedChanges reports whether the branch holds hunks its last push
+// does not contain. The hunks are applied to the pushed commit, so edits
+// that leave them alone, such as a rename or moving a hunk out, do not count.
+func hasUnpushedChanges(branch *VirtualBranch) bool {
+	if len(branch.Hunks) == 0 {
+		return false
+	}
+	if branch.PushedCommit == "" || len(conflictedHunks(branch)) > 0 {
+		return true
+	}
+	pushed, err := runGit(nil, "", "rev-parse", "--verify", "--quiet", branch.PushedCommit+"^{tree}")
+	if err != nil {
+		return true
+	}
+	tree, err := buildBranchTree(branch, branch.PushedCommit)
+	return err != nil || tree != pushed
+}
+
+// moveHunk hands the hunk at index in source to target, along with the
+// base it was recorded against, and updates both branches' file records
+func moveHunk(source *VirtualBranch, index int, target *VirtualBranch) error {
+	hunk := source.Hunks[index]
+	if holdsFile(target, hunk.File) && getBaseBlob(source, hunk.File) != getBaseBlob(target, hunk.File) {
+		return fmt.Errorf("branches %s and %s hold hunks of %s recorded against different bases; run 'stick rebase' first", source.Name, target.Name, hunk.File)
+	}
+	source.Hunks = append(source.Hunks[:index], source.Hunks[index+1:]...)
+	target.Hunks = append(target.Hunks, hunk)
+	// a rename was recorded against its source, so that base goes along
+	for _, filename := range []string{hunk.File, hunk.OldFile} {
+		if blob, recorded := source.BaseBlobs[filename]; recorded && filename != "" {
+			if target.BaseBlobs == nil {
+				target.BaseBlobs = make(map[string]string)
+			}
+			target.BaseBlobs[filename] = blob
 		}
 	}
-	for _, filename := range branch.DeletedFiles {
-		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+	if target.BaseCommit == "" {
+		target.BaseCommit = source.BaseCommit
+	}
+	source.UpdatedAt = time.Now()
+	target.UpdatedAt = time.Now()
+
+	if hunk.Binary || hunk.isRename() {
+		// the hunk is the whole file, so its record goes along unchanged
+		moveFileRecord(source, target, hunk.File)
+		if hunk.Type == "rename" {
+			moveFileRecord(source, target, hunk.OldFile)
+		}
+		return nil
+	}
+	for _, branch := range []*VirtualBranch{source, target} {
+		if !holdsFile(branch, hunk.File) {
+			delete(branch.Files, hunk.File)
+			removeDeletedFile(branch, hunk.File)
+			continue
+		}
+		if err := rebuildFile(branch, hunk.File); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func unapplyVirtualBranch(branch *VirtualBranch) error {
-	files := append([]string{}, branch.DeletedFiles...)
-	for file := range branch.Files {
-		files = append(files, file)
+// holdsFile reports whether the branch has a hunk for filename
+func holdsFile(branch *VirtualBranch, filename string) bool {
+	return slices.ContainsFunc(branch.Hunks, func(h Hunk) bool { return h.File == filename })
+}
+
+// moveFileRecord moves source's version of filename, or its record that
+// the file is deleted, to target
+func moveFileRecord(source, target *VirtualBranch, filename string) {
+	if blob, recorded := source.Files[filename]; recorded {
+		if target.Files == nil {
+			target.Files = make(map[string]string)
+		}
+		target.Files[filename] = blob
+		delete(source.Files, filename)
 	}
-	for _, file := range files {
-		cmd := exec.Command("git", "checkout", "HEAD", "--", file)
-		if err := cmd.Run(); err != nil {
+	if slices.Contains(source.DeletedFiles, filename) {
+		removeDeletedFile(source, filename)
+		if !slices.Contains(target.DeletedFiles, filename) {
+			target.DeletedFiles = append(target.DeletedFiles, filename)
+		}
+	}
+}
+
+// rebuildFile renumbers the branch's hunks in filename so their new-side
+// ranges stay correct together, and records the branch's version of the
+// file: its base with only the branch's own hunks applied
+func rebuildFile(branch *VirtualBranch, filename string) error {
+	var indexes []int
+	removed := false
+	for i, hunk := range branch.Hunks {
+		if hunk.File == filename && !hunk.Conflicted && !hunk.isMode() && !hunk.Binary && !hunk.isRename() {
+			indexes = append(indexes, i)
+			removed = removed || hunk.Type == "remove"
+		}
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return branch.Hunks[indexes[a]].OldStart < branch.Hunks[indexes[b]].OldStart
+	})
+	patches := make([]diff.Hunk, len(indexes))
+	for k, i := range indexes {
+		patch, err := branch.Hunks[i].patch()
+		if err != nil {
 			return err
 		}
+		patches[k] = patch
+	}
+	for k, h := range diff.Renumber(patches) {
+		hunk := &branch.Hunks[indexes[k]]
+		hunk.NewStart = h.NewStart
+		hunk.StartLine = h.NewStart
+		hunk.EndLine = h.NewStart + h.NewLines - 1
 	}
+
+	base, err := getBaseContent(branch, filename)
+	if err != nil {
+		return err
+	}
+	lines, failed := diff.Apply(diff.SplitLines(base), patches)
+	if len(failed) > 0 {
+		return fmt.Errorf("hunks for %s no longer match their recorded base", filename)
+	}
+	content := strings.Join(lines, "")
+	delete(branch.Files, filename)
+	removeDeletedFile(branch, filename)
+	if content == "" && removed {
+		branch.DeletedFiles = append(branch.DeletedFiles, filename)
+		return nil
+	}
+	return setFileContent(branch, filename, content)
+}
+
+// mergeBranchInto hands every hunk and file record of source to target.
+// A file both branches touch gets target's version rebuilt from the
+// combined hunks, which must have been recorded against the same base.
+func mergeBranchInto(source, target *VirtualBranch) error {
+	shared, _ := hunksByFile(source)
+	var both []string
+	for _, filename := range shared {
+		if !holdsFile(target, filename) {
+			continue
+		}
+		if getBaseBlob(source, filename) != getBaseBlob(target, filename) {
+			return fmt.Errorf("branches %s and %s hold hunks of %s recorded against different bases; run 'stick rebase' first", source.Name, target.Name, filename)
+		}
+		both = append(both, filename)
+	}
+
+	if target.Files == nil {
+		target.Files = make(map[string]string)
+	}
+	if target.BaseBlobs == nil {
+		target.BaseBlobs = make(map[string]string)
+	}
+	for filename, blob := range source.Files {
+		if !slices.Contains(both, filename) {
+			target.Files[filename] = blob
+		}
+	}
+	for filename, blob := range source.BaseBlobs {
+		if _, exists := target.BaseBlobs[filename]; !exists {
+			target.BaseBlobs[filename] = blob
+		}
+	}
+	if target.BaseCommit == "" {
+		target.BaseCommit = source.BaseCommit
+	}
+	for _, filename := range source.DeletedFiles {
+		if !slices.Contains(target.DeletedFiles, filename) {
+			target.DeletedFiles = append(target.DeletedFiles, filename)
+		}
+	}
+	target.Hunks = append(target.Hunks, source.Hunks...)
+	for _, filename := range both {
+		if err := rebuildFile(target, filename); err != nil {
+			return err
+		}
+	}
+	target.UpdatedAt = time.Now()
 	return nil
 }
 
+// editText opens the user's editor on initial and returns what was saved,
+// without lines starting with '#'
+func editText(initial string) (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor, _ = runGit(nil, "", "var", "GIT_EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "stick-description-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(initial); err != nil {
+		f.Close()
+		return "", err
+	}
+	f.Close()
+
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], f.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %s failed: %v", editor, err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// applyVirtualBranch replays the branch's hunks onto the working tree,
+// reporting hunks that conflict with edits made since they were recorded
+func applyVirtualBranch(branch *VirtualBranch) ([]HunkConflict, error) {
+	var conflicts []HunkConflict
+	files, grouped := hunksByFile(branch)
+	for _, filename := range files {
+		fileConflicts, err := patchFile(branch, filename, grouped[filename], false)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, fileConflicts...)
+	}
+	for _, hunk := range append(renameHunks(branch), binaryHunks(branch)...) {
+		renameConflicts, err := patchRename(branch, hunk, false)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, renameConflicts...)
+	}
+	// modes change once the files have their new content
+	for _, hunk := range modeHunks(branch) {
+		modeConflicts, err := patchMode(hunk, false)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, modeConflicts...)
+	}
+	branch.Active = true
+	return conflicts, nil
+}
+
+// unapplyVirtualBranch takes the branch's hunks back out of the working
+// tree, leaving every other change in those files in place
+func unapplyVirtualBranch(branch *VirtualBranch) ([]HunkConflict, error) {
+	var conflicts []HunkConflict
+	// modes go back first, so a symlink is a file again before its content is
+	for _, hunk := range modeHunks(branch) {
+		modeConflicts, err := patchMode(hunk, true)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, modeConflicts...)
+	}
+	files, grouped := hunksByFile(branch)
+	for _, filename := range files {
+		fileConflicts, err := patchFile(branch, filename, grouped[filename], true)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, fileConflicts...)
+	}
+	for _, hunk := range append(renameHunks(branch), binaryHunks(branch)...) {
+		renameConflicts, err := patchRename(branch, hunk, true)
+		if err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, renameConflicts...)
+	}
+	branch.Active = false
+	return conflicts, nil
+}
+
 func syncWithGit() error {
 	// Get current Git status and update virtual branches accordingly
-	gitFiles := getGitStatus()
+	gitFiles, err := changedPaths()
+	if err != nil {
+		return err
+	}
 
 	if len(gitFiles) == 0 {
 		return nil
@@ -127,12 +723,9 @@ func syncWithGit() error {
 	// If there's a current branch, add uncommitted changes to it
 	if state.CurrentBranch != "" {
 		branch := state.Branches[state.CurrentBranch]
-		for _, file := range gitFiles {
-			if len(file) > 3 {
-				filename := strings.TrimSpace(file[3:])
-				if err := addFileToVirtualBranch(branch, filename); err != nil {
-					fmt.Printf("Warning: Could not add %s: %v\n", filename, err)
-				}
+		for _, filename := range gitFiles {
+			if err := addFileToVirtualBranch(branch, filename); err != nil {
+				say("Warning: Could not add %s: %v", filename, err)
 			}
 		}
 		branch.UpdatedAt = time.Now()
@@ -141,61 +734,308 @@ func syncWithGit() error {
 	return nil
 }
 
-func getFileStatus(filename string) string {
-	cmd := exec.Command("git", "status", "--porcelain", filename)
+// isAncestor reports whether commit a is an ancestor of, or the same as, commit b
+func isAncestor(a, b string) bool {
+	_, err := runGit(nil, "", "merge-base", "--is-ancestor", a, b)
+	return err == nil
+}
+
+// getHeadCommit returns the commit HEAD points at
+func getHeadCommit() (string, error) {
+	return runGit(nil, "", "rev-parse", "--verify", "HEAD^{commit}")
+}
+
+func shortCommit(commit string) string {
+	return commit[:min(7, len(commit))]
+}
+
+// Staleness describes how far HEAD has moved past a branch's base
+type Staleness struct {
+	Behind       int      `json:"behind"`        // commits between the base and HEAD
+	Touching     int      `json:"touching"`      // of those, commits that modify the branch's files
+	ChangedFiles []string `json:"changed_files"` // branch files whose HEAD blob differs from the recorded base blob
+	Diverged     bool     `json:"diverged"`      // the base is not an ancestor of HEAD
+}
+
+// branchStaleness compares a branch's base with HEAD, returning nil when
+// the base is current or unknown
+func branchStaleness(branch *VirtualBranch) (*Staleness, error) {
+	head, err := getHeadCommit()
+	if err != nil {
+		return nil, err
+	}
+	if branch.BaseCommit == "" || branch.BaseCommit == head {
+		return nil, nil
+	}
+
+	stale := &Staleness{}
+	if !isAncestor(branch.BaseCommit, head) {
+		stale.Diverged = true
+	}
+
+	files, _ := hunksByFile(branch)
+	count, err := runGit(nil, "", "rev-list", "--count", branch.BaseCommit+".."+head)
+	if err != nil {
+		return nil, err
+	}
+	stale.Behind, _ = strconv.Atoi(count)
+	if len(files) > 0 {
+		args := append([]string{"rev-list", "--count", branch.BaseCommit + ".." + head, "--"}, files...)
+		count, err := runGit(nil, "", args...)
+		if err != nil {
+			return nil, err
+		}
+		stale.Touching, _ = strconv.Atoi(count)
+	}
+
+	for _, filename := range files {
+		if blob, recorded := branch.BaseBlobs[filename]; recorded && blob != getHeadBlob(filename) {
+			stale.ChangedFiles = append(stale.ChangedFiles, filename)
+		}
+	}
+	return stale, nil
+}
+
+// getHeadContent returns the content of filename at HEAD and whether it exists there
+func getHeadContent(filename string) (string, bool) {
+	cmd := gitCommand("show", "HEAD:"+filename)
 	output, err := cmd.Output()
 	if err != nil {
-		return ""
+		return "", false
 	}
-	status := strings.TrimSpace(string(output))
-	if status != "" {
-		return status[:2] // First two characters (e.g., " M", "??", " D")
+	return string(output), true
+}
+
+// changeKey identifies a hunk by its added and removed lines only, so the
+// same change is recognised even when its position or context shifts
+func changeKey(content string) string {
+	lines, err := diff.ParseBody(content)
+	if err != nil {
+		return content
 	}
-	return ""
+	var sb strings.Builder
+	for _, line := range lines {
+		if line.Op != diff.Equal {
+			sb.WriteByte(byte(line.Op))
+			sb.WriteString(line.Text)
+		}
+	}
+	return sb.String()
 }
 
-func addFileToVirtualBranch(branch *VirtualBranch, filename string) error {
-	status := getFileStatus(filename)
-	if status == "" {
-		return fmt.Errorf("file %s is not tracked or has no changes", filename)
+// isClaimedByOtherBranch reports whether another virtual branch already owns this change
+func isClaimedByOtherBranch(branch *VirtualBranch, filename, key string) bool {
+	for _, other := range state.Branches {
+		if other.ID == branch.ID {
+			continue
+		}
+		for _, hunk := range other.Hunks {
+			if hunk.File == filename && changeKey(hunk.Content) == key {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	// Handle deleted files
-	if status[1] == 'D' { // Deleted in working tree
-		branch.DeletedFiles = append(branch.DeletedFiles, filename)
-		hunk := Hunk{
-			ID:        generateID(),
-			File:      filename,
-			Type:      "remove",
-			CreatedAt: time.Now(),
+// withoutOtherBranches takes the changes other branches hold for filename
+// back out of current, leaving HEAD plus this branch's own edits. A diff of
+// the result against HEAD never merges a neighbouring change that belongs
+// to another branch into one of this branch's hunks.
+func withoutOtherBranches(branch *VirtualBranch, filename, base, current string) (string, error) {
+	headBlob := getHeadBlob(filename)
+	var patches []diff.Hunk
+	var owners []string
+	for _, other := range state.Branches {
+		if other.ID == branch.ID || getBaseBlob(other, filename) != headBlob {
+			continue
 		}
-		branch.Hunks = append(branch.Hunks, hunk)
+		for _, hunk := range other.Hunks {
+			if hunk.File != filename || hunk.Conflicted || hunk.isMode() || hunk.Binary || hunk.isRename() {
+				continue
+			}
+			p, err := hunk.patch()
+			if err != nil {
+				return "", err
+			}
+			patches = append(patches, p)
+			if !slices.Contains(owners, other.Name) {
+				owners = append(owners, other.Name)
+			}
+		}
+	}
+	if len(patches) == 0 {
+		return current, nil
+	}
+
+	// hunks that no longer apply to HEAD are left to isClaimedByOtherBranch
+	baseLines := diff.SplitLines(base)
+	others, _ := diff.Apply(baseLines, patches)
+	merged, collisions := diff.Merge3(others, diff.SplitLines(current), baseLines)
+	if len(collisions) > 0 {
+		sort.Strings(owners)
+		return "", fmt.Errorf("changes to %s overlap hunks held by virtual branch %s; move those hunks first", filename, strings.Join(owners, ", "))
+	}
+	return strings.Join(merged, ""), nil
+}
+
+// buildHunks diffs base against current and turns each hunk into a record for filename
+func buildHunks(filename, base, current, hunkType string) []Hunk {
+	var hunks []Hunk
+	taken := make(map[string]bool)
+	for _, h := range diff.Hunks(diff.SplitLines(base), diff.SplitLines(current), diff.DefaultContext) {
+		hunks = append(hunks, newHunk(filename, h, hunkType, taken))
+	}
+	return hunks
+}
+
+// newHunk turns a diff hunk into a record for filename, with an ID not in taken
+func newHunk(filename string, h diff.Hunk, hunkType string, taken map[string]bool) Hunk {
+	content := h.Body()
+	id := hunkID(filename, content, taken)
+	taken[id] = true
+	return Hunk{
+		ID:        id,
+		File:      filename,
+		StartLine: h.NewStart,
+		EndLine:   h.NewStart + h.NewLines - 1,
+		OldStart:  h.OldStart,
+		OldLines:  h.OldLines,
+		NewStart:  h.NewStart,
+		NewLines:  h.NewLines,
+		Content:   content,
+		Type:      hunkType,
+		Context:   h.Context(),
+		CreatedAt: time.Now(),
+	}
+}
+
+// checkRemoteBase refuses to record hunks against HEAD on a branch created
+// from a remote branch while HEAD does not contain that base: moving the
+// base to HEAD would lose it, and pushing would revert its commits
+func checkRemoteBase(branch *VirtualBranch) error {
+	if branch.BaseRef == "" || branch.BaseCommit == "" {
+		return nil
+	}
+	head, err := getHeadCommit()
+	if err != nil || isAncestor(branch.BaseCommit, head) {
 		return nil
 	}
+	base := shortCommit(branch.BaseCommit)
+	return fmt.Errorf("branch '%s' is based on %s at %s, which HEAD does not contain; run 'git switch --detach %s' before adding to it, or 'stick rebase' it onto HEAD", branch.Name, branch.BaseRef, base, base)
+}
 
-	// Handle new or modified files
-	if status[0] == '?' || status[1] == 'M' || status[0] == 'A' { // New (??), modified ( M), or added (A )
-		content, err := os.ReadFile(filename)
+// recordBaseCommit moves the branch's base to HEAD as new hunks are
+// recorded against it, warning when older hunks were recorded elsewhere
+func recordBaseCommit(branch *VirtualBranch) {
+	head, err := getHeadCommit()
+	if err != nil {
+		return
+	}
+	if branch.BaseCommit != "" && branch.BaseCommit != head && len(branch.Hunks) > 0 {
+		say("warning: HEAD moved since branch %s was recorded at %s; run 'stick rebase' to bring its other hunks along", branch.Name, shortCommit(branch.BaseCommit))
+	}
+	branch.BaseCommit = head
+}
+
+func addFileToVirtualBranch(branch *VirtualBranch, filename string) error {
+	status, err := getFileStatus(filename)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return fmt.Errorf("file %s is not tracked or has no changes", filename)
+	}
+	if status.IsSubmodule() {
+		return fmt.Errorf("%s is a submodule; stick does not track submodule changes", filename)
+	}
+	pair, err := findRename(filename)
+	if err != nil {
+		return err
+	}
+	if pair != nil {
+		current, err := worktreeVersion(pair.Dest)
 		if err != nil {
 			return err
 		}
-		branch.Files[filename] = string(content)
-		hunkType := "modify"
-		if status[0] == '?' { // New file
-			hunkType = "add"
+		return recordRename(branch, *pair, current)
+	}
+
+	current, err := worktreeVersion(filename)
+	if err != nil {
+		return err
+	}
+	return recordFile(branch, filename, current)
+}
+
+// recordFile records the change from HEAD to current, the working tree or
+// index version of filename, as the branch's hunks for the file
+func recordFile(branch *VirtualBranch, filename string, current fileVersion) error {
+	base, inHead := getHeadContent(filename)
+	headMode := getHeadMode(filename)
+
+	hunkType := "modify"
+	switch {
+	case !inHead && !current.Exists:
+		return fmt.Errorf("file %s has no changes to add", filename)
+	case !inHead:
+		hunkType = "add"
+	case !current.Exists:
+		hunkType = "remove"
+	}
+	if isBinary(base) || isBinary(current.Content) {
+		return recordBinary(branch, filename, current, hunkType)
+	}
+	if err := checkRemoteBase(branch); err != nil {
+		return err
+	}
+
+	content := current.Content
+	if hunkType == "modify" {
+		var err error
+		if content, err = withoutOtherBranches(branch, filename, base, content); err != nil {
+			return err
+		}
+	}
+
+	// re-recording a file replaces whatever this branch held for it before,
+	// including a rename it was part of; a copy of it stays
+	kept := branch.Hunks[:0]
+	for _, hunk := range branch.Hunks {
+		if hunk.File != filename && (hunk.OldFile != filename || hunk.Type == "copy") {
+			kept = append(kept, hunk)
 		}
-		hunk := Hunk{
-			ID:        generateID(),
-			File:      filename,
-			StartLine: 1,
-			EndLine:   len(strings.Split(string(content), "\n")),
-			Content:   string(content),
-			Type:      hunkType,
-			CreatedAt: time.Now(),
+	}
+	branch.Hunks = kept
+	delete(branch.Files, filename)
+	removeDeletedFile(branch, filename)
+
+	if branch.BaseBlobs == nil {
+		branch.BaseBlobs = make(map[string]string)
+	}
+	branch.BaseBlobs[filename] = getHeadBlob(filename)
+	recordBaseCommit(branch)
+
+	added := 0
+	for _, hunk := range buildHunks(filename, base, content, hunkType) {
+		if isClaimedByOtherBranch(branch, filename, changeKey(hunk.Content)) {
+			continue
 		}
+		hunk.OldMode, hunk.NewMode = creationModes(hunkType, headMode, current.Mode)
 		branch.Hunks = append(branch.Hunks, hunk)
-		return nil
+		added++
+	}
+	if hunkType == "modify" && headMode != current.Mode && recordMode(branch, filename, headMode, current.Mode) {
+		added++
 	}
 
-	return fmt.Errorf("file %s has no changes to add", filename)
+	if added == 0 {
+		return fmt.Errorf("all changes in %s already belong to other virtual branches", filename)
+	}
+	if current.Exists {
+		return setFileContent(branch, filename, content)
+	} else {
+		branch.DeletedFiles = append(branch.DeletedFiles, filename)
+	}
+	return nil
 }
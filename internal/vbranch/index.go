@@ -0,0 +1,171 @@
+package vbranch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// fileVersion is one version of a file, from the working tree or the index
+type fileVersion struct {
+	Content string
+	Mode    string
+	Exists  bool
+}
+
+// worktreeVersion reads filename from the working tree
+func worktreeVersion(filename string) (fileVersion, error) {
+	content, exists, err := readWorkingFile(filename)
+	if err != nil || !exists {
+		return fileVersion{}, err
+	}
+	mode, _, err := worktreeMode(filename)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{Content: content, Mode: mode, Exists: true}, nil
+}
+
+// indexVersion reads filename as it is staged in the index. A file with
+// unresolved conflicts has no single staged version and is an error.
+func indexVersion(filename string) (fileVersion, error) {
+	output, err := gitCommand("ls-files", "--stage", "-z", "--", ":(literal)"+filename).Output()
+	if err != nil {
+		return fileVersion{}, fmt.Errorf("reading the index: %v", err)
+	}
+	for _, record := range strings.Split(string(output), "\x00") {
+		// mode blob stage\tpath
+		meta, path, found := strings.Cut(record, "\t")
+		if !found || path != filename {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 {
+			return fileVersion{}, fmt.Errorf("malformed index entry %q", record)
+		}
+		if fields[2] != "0" {
+			return fileVersion{}, fmt.Errorf("%s has unresolved conflicts in the index", filename)
+		}
+		content, err := getBlobContent(fields[1])
+		if err != nil {
+			return fileVersion{}, err
+		}
+		return fileVersion{Content: content, Mode: fields[0], Exists: true}, nil
+	}
+	return fileVersion{}, nil
+}
+
+// stagedPaths lists the paths with changes staged in the index; a rename
+// or copy is listed by its destination
+func stagedPaths() ([]string, error) {
+	entries, err := getGitStatus()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if (entry.Kind == '1' || entry.Kind == '2') && entry.Index != '.' && !entry.IsSubmodule() {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths, nil
+}
+
+// addStagedFile records the change staged for filename, exactly as it is
+// in the index, leaving any unstaged edits to the file out of the branch
+func addStagedFile(branch *VirtualBranch, filename string) error {
+	// a pathspec would hide the other side of a staged rename, so the
+	// whole status is read
+	entries, err := getGitStatus()
+	if err != nil {
+		return err
+	}
+	var status *StatusEntry
+	for i, entry := range entries {
+		if slices.Contains(entry.Paths(), filename) {
+			status = &entries[i]
+			break
+		}
+	}
+	switch {
+	case status != nil && status.Kind == 'u':
+		return fmt.Errorf("%s has unresolved conflicts; resolve them first", filename)
+	case status != nil && status.IsSubmodule():
+		return fmt.Errorf("%s is a submodule; stick does not track submodule changes", filename)
+	case status == nil || status.Kind == '?' || status.Kind == '!' || status.Index == '.':
+		return fmt.Errorf("file %s has no staged changes", filename)
+	}
+
+	if status.Kind == '2' && renameThreshold != 0 {
+		pair := renamePair{Kind: "rename", Source: status.OrigPath, Dest: status.Path}
+		if status.Index == 'C' {
+			pair.Kind = "copy"
+		}
+		current, err := indexVersion(pair.Dest)
+		if err != nil {
+			return err
+		}
+		return recordRename(branch, pair, current)
+	}
+
+	current, err := indexVersion(filename)
+	if err != nil {
+		return err
+	}
+	return recordFile(branch, filename, current)
+}
+
+// AddStaged adds what is staged in the index for each of paths, or for
+// every staged path when none are given, to the current branch
+func AddStaged(paths []string) error {
+	branch := state.Branches[state.CurrentBranch]
+	staged, err := stagedPaths()
+	if err != nil {
+		return err
+	}
+	all := len(paths) == 0
+	if all {
+		if len(staged) == 0 {
+			say("nothing is staged in the index")
+			return nil
+		}
+		paths = staged
+	} else {
+		paths = expandPaths(paths, staged)
+	}
+
+	failed, err := addFiles(branch, paths, addStagedFile, "added staged %s to virtual branch %s")
+	if err != nil {
+		return err
+	}
+	if failed > 0 && (!all || failed == len(paths)) {
+		return fmt.Errorf("%d of %d file(s) could not be added", failed, len(paths))
+	}
+	return nil
+}
+
+// StageBranch loads the branch's hunks into the index, replacing the staged
+// version of every file the branch touches with HEAD plus its hunks. The
+// working tree and the staged versions of other files are left alone.
+func StageBranch(branchName *string) error {
+	branch, err := resolveBranchOrCurrent(branchName)
+	if err != nil {
+		return err
+	}
+	if conflicted := conflictedHunks(branch); len(conflicted) > 0 {
+		return &ConflictError{Message: fmt.Sprintf("branch '%s' has %d conflicting hunk(s) from a rebase; resolve them and 'stick add' the files first", branch.Name, len(conflicted))}
+	}
+	head, err := getHeadCommit()
+	if err != nil {
+		return err
+	}
+	if err := stageBranch(branch, head, nil); err != nil {
+		if branch.BaseCommit != "" && branch.BaseCommit != head {
+			return fmt.Errorf("%w; HEAD moved since branch '%s' was recorded, run 'stick rebase' first", err, branch.Name)
+		}
+		return err
+	}
+	emit(branchOutput(branch))
+	say("staged virtual branch %s in the index", branch.Name)
+	return nil
+}
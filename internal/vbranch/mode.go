@@ -0,0 +1,223 @@
+package vbranch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Git file modes stick records; any other mode is treated as a regular file
+const (
+	modeRegular    = "100644"
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+)
+
+// trustFileMode caches core.fileMode; when it is false the executable bit
+// in the working tree means nothing and HEAD's mode is kept
+var trustFileMode *bool
+
+func fileModeTrusted() bool {
+	if trustFileMode == nil {
+		value, err := runGit(nil, "", "config", "--type=bool", "core.fileMode")
+		trusted := err != nil || value != "false"
+		trustFileMode = &trusted
+	}
+	return *trustFileMode
+}
+
+// orRegular returns mode, or the regular file mode when it is unset
+func orRegular(mode string) string {
+	if mode == "" {
+		return modeRegular
+	}
+	return mode
+}
+
+// worktreeMode returns the Git mode of the working tree copy of filename
+// and whether it exists. Symlinks are not followed.
+func worktreeMode(filename string) (string, bool, error) {
+	info, err := os.Lstat(worktreePath(filename))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return modeSymlink, true, nil
+	case !fileModeTrusted():
+		if mode, blob := treeBlob("HEAD", filename); blob != "" && mode != modeSymlink {
+			return mode, true, nil
+		}
+		return modeRegular, true, nil
+	case info.Mode()&0100 != 0:
+		return modeExecutable, true, nil
+	}
+	return modeRegular, true, nil
+}
+
+// modePerm returns perm with the executable bits git mode calls for: set
+// wherever it is readable for 100755, cleared otherwise
+func modePerm(perm os.FileMode, mode string) os.FileMode {
+	if mode == modeExecutable {
+		return perm | (perm&0444)>>2
+	}
+	return perm &^ 0111
+}
+
+// writeFileMode writes content to filename as a file of the given Git mode,
+// replacing whatever is there. A symlink's content is its target.
+func writeFileMode(filename, content, mode string) error {
+	path := worktreePath(filename)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(path); err == nil && (mode == modeSymlink || info.Mode()&os.ModeSymlink != 0) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if mode == modeSymlink {
+		return os.Symlink(content, path)
+	}
+	perm := os.FileMode(0644)
+	if mode == modeExecutable {
+		perm = 0755
+	}
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := modePerm(info.Mode().Perm(), mode); perm != info.Mode().Perm() {
+		return os.Chmod(path, perm)
+	}
+	return nil
+}
+
+// getHeadMode returns the mode of filename at HEAD, or "" if it is not there
+func getHeadMode(filename string) string {
+	mode, blob := treeBlob("HEAD", filename)
+	if blob == "" {
+		return ""
+	}
+	return mode
+}
+
+// creationModes returns the modes a hunk of hunkType carries: the mode of
+// the file an addition creates or a removal deletes
+func creationModes(hunkType, headMode, mode string) (string, string) {
+	switch hunkType {
+	case "add":
+		return "", mode
+	case "remove":
+		return headMode, ""
+	}
+	return "", ""
+}
+
+// isMode reports whether the hunk only changes its file's mode
+func (h Hunk) isMode() bool {
+	return h.Type == "mode"
+}
+
+// modeHunks returns the branch's mode changes, leaving out hunks left
+// conflicted by a rebase
+func modeHunks(branch *VirtualBranch) []Hunk {
+	var out []Hunk
+	for _, hunk := range branch.Hunks {
+		if hunk.isMode() && !hunk.Conflicted {
+			out = append(out, hunk)
+		}
+	}
+	return out
+}
+
+// modeSummary describes a mode change, e.g. "mode changed (100644 → 100755)"
+func modeSummary(oldMode, newMode string) string {
+	return fmt.Sprintf("mode changed (%s → %s)", oldMode, newMode)
+}
+
+// newModeHunk records the change of filename's mode from oldMode to newMode
+func newModeHunk(filename, oldMode, newMode string, taken map[string]bool) Hunk {
+	id := hunkID(filename, "mode\x00"+oldMode+"\x00"+newMode, taken)
+	taken[id] = true
+	return Hunk{
+		ID:        id,
+		File:      filename,
+		Type:      "mode",
+		OldMode:   oldMode,
+		NewMode:   newMode,
+		CreatedAt: time.Now(),
+	}
+}
+
+// modeAssigned reports whether a branch other than branch, if given,
+// holds the change of filename's mode to newMode
+func modeAssigned(branch *VirtualBranch, filename, newMode string) bool {
+	for _, other := range state.Branches {
+		if branch != nil && other.ID == branch.ID {
+			continue
+		}
+		for _, hunk := range other.Hunks {
+			if hunk.File == filename && hunk.isMode() && hunk.NewMode == newMode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordMode adds the change of filename's mode to branch as its own hunk,
+// replacing any mode change the branch held for the file. It reports
+// false when another branch already holds the change.
+func recordMode(branch *VirtualBranch, filename, oldMode, newMode string) bool {
+	if modeAssigned(branch, filename, newMode) {
+		return false
+	}
+	taken := make(map[string]bool)
+	kept := branch.Hunks[:0]
+	for _, hunk := range branch.Hunks {
+		if hunk.File == filename && hunk.isMode() {
+			continue
+		}
+		kept = append(kept, hunk)
+		taken[hunk.ID] = true
+	}
+	branch.Hunks = append(kept, newModeHunk(filename, oldMode, newMode, taken))
+	branch.UpdatedAt = time.Now()
+	return true
+}
+
+// patchMode switches a file from the hunk's old mode to its new one, or
+// back when reverse is set. A file whose mode was changed otherwise since
+// is left alone and reported as a conflict.
+func patchMode(hunk Hunk, reverse bool) ([]HunkConflict, error) {
+	from, to := hunk.OldMode, hunk.NewMode
+	if reverse {
+		from, to = to, from
+	}
+	current, exists, err := worktreeMode(hunk.File)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !exists && reverse:
+		return nil, nil // the file went with the rest of the branch
+	case current == to:
+		return nil, nil
+	case !exists || current != from:
+		return []HunkConflict{{HunkID: hunk.ID, File: hunk.File}}, nil
+	}
+
+	content, _, err := readWorkingFile(hunk.File)
+	if err != nil {
+		return nil, err
+	}
+	return nil, writeFileMode(hunk.File, content, to)
+}
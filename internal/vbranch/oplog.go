@@ -0,0 +1,414 @@
+package vbranch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tesh254/stick/internal/constants"
+	"github.com/tesh254/stick/internal/stickdir"
+)
+
+// Operation is one entry of the operation log: the state and the working
+// tree files a command could touch, captured before and after it ran
+type Operation struct {
+	ID          string            `json:"id"`
+	Parent      string            `json:"parent"` // operation that was current when this one ran
+	Command     string            `json:"command"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Before      json.RawMessage   `json:"before"`
+	After       json.RawMessage   `json:"after"`
+	BeforeFiles map[string]string `json:"before_files"` // path -> blob ID, "" when the file did not exist
+	AfterFiles  map[string]string `json:"after_files"`
+	BeforeModes map[string]string `json:"before_modes,omitempty"` // path -> git mode of each existing file
+	AfterModes  map[string]string `json:"after_modes,omitempty"`
+}
+
+// fileSnapshot is the working tree copy of a set of files
+type fileSnapshot struct {
+	Files map[string]string // path -> blob ID, "" when the file did not exist
+	Modes map[string]string // path -> git mode; missing in logs written before modes were kept
+}
+
+func (op *Operation) before() fileSnapshot {
+	return fileSnapshot{Files: op.BeforeFiles, Modes: op.BeforeModes}
+}
+
+func (op *Operation) after() fileSnapshot {
+	return fileSnapshot{Files: op.AfterFiles, Modes: op.AfterModes}
+}
+
+// PendingOperation is a command being recorded into the operation log
+type PendingOperation struct {
+	command     string
+	before      []byte
+	beforeFiles fileSnapshot
+}
+
+// BeginOperation snapshots the state and working tree before a mutating
+// command runs. Must be called with the state lock held.
+func BeginOperation(command string) (*PendingOperation, error) {
+	before, err := encodeState(state, false)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := operationPaths(nil)
+	if err != nil {
+		return nil, err
+	}
+	files, err := snapshotFiles(paths, true)
+	if err != nil {
+		return nil, err
+	}
+	return &PendingOperation{command: command, before: before, beforeFiles: files}, nil
+}
+
+// Finish records the operation if the command changed anything
+func (op *PendingOperation) Finish() error {
+	after, err := encodeState(state, false)
+	if err != nil {
+		return err
+	}
+	paths, err := operationPaths(op.beforeFiles.Files)
+	if err != nil {
+		return err
+	}
+	afterFiles, err := snapshotFiles(paths, true)
+	if err != nil {
+		return err
+	}
+
+	// files that only appeared afterwards did not exist before
+	for path := range afterFiles.Files {
+		if _, ok := op.beforeFiles.Files[path]; !ok {
+			op.beforeFiles.Files[path] = ""
+		}
+	}
+
+	if bytes.Equal(op.before, after) && sameSnapshot(op.beforeFiles, afterFiles) {
+		return nil
+	}
+
+	head, err := readOplogHead()
+	if err != nil {
+		return err
+	}
+	entry := Operation{
+		ID:          generateID(),
+		Parent:      head,
+		Command:     op.command,
+		CreatedAt:   time.Now(),
+		Before:      op.before,
+		After:       after,
+		BeforeFiles: op.beforeFiles.Files,
+		AfterFiles:  afterFiles.Files,
+		BeforeModes: op.beforeFiles.Modes,
+		AfterModes:  afterFiles.Modes,
+	}
+	if err := appendOperation(entry); err != nil {
+		return err
+	}
+	return writeOplogHead(entry.ID)
+}
+
+// operationPaths lists the files a command may touch: everything with
+// uncommitted changes, every file a lane holds hunks for, and extra
+func operationPaths(extra map[string]string) ([]string, error) {
+	seen := make(map[string]bool)
+	changed, err := changedPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range changed {
+		seen[path] = true
+	}
+	for _, branch := range state.Branches {
+		for _, hunk := range branch.Hunks {
+			seen[hunk.File] = true
+			if hunk.isRename() {
+				seen[hunk.OldFile] = true
+			}
+		}
+	}
+	for path := range extra {
+		seen[path] = true
+	}
+
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// snapshotFiles hashes the working tree copy of each path along with its
+// mode, storing the blobs in the object database when write is set. A
+// symlink is recorded as its target, the way git stores it.
+func snapshotFiles(paths []string, write bool) (fileSnapshot, error) {
+	snap := fileSnapshot{Files: make(map[string]string), Modes: make(map[string]string)}
+	var existing []string
+	for _, path := range paths {
+		info, err := os.Lstat(worktreePath(path))
+		switch {
+		case os.IsNotExist(err):
+			snap.Files[path] = ""
+			continue
+		case err != nil:
+			return snap, err
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _, err := readWorkingFile(path)
+			if err != nil {
+				return snap, err
+			}
+			blob, err := hashContent(target, write)
+			if err != nil {
+				return snap, err
+			}
+			snap.Files[path] = blob
+		case info.Mode().IsRegular():
+			existing = append(existing, path)
+		default:
+			continue
+		}
+		mode, _, err := worktreeMode(path)
+		if err != nil {
+			return snap, err
+		}
+		snap.Modes[path] = mode
+	}
+	if len(existing) == 0 {
+		return snap, nil
+	}
+
+	args := []string{"hash-object", "--stdin-paths", "--no-filters"}
+	if write {
+		args = append(args, "-w")
+	}
+	output, err := runGit(nil, strings.Join(existing, "\n")+"\n", args...)
+	if err != nil {
+		return snap, err
+	}
+	blobs := strings.Split(output, "\n")
+	if len(blobs) != len(existing) {
+		return snap, fmt.Errorf("hashed %d of %d files", len(blobs), len(existing))
+	}
+	for i, path := range existing {
+		snap.Files[path] = blobs[i]
+		if write {
+			queueBlob(blobs[i])
+		}
+	}
+	return snap, nil
+}
+
+func sameSnapshot(a, b fileSnapshot) bool {
+	if len(a.Files) != len(b.Files) {
+		return false
+	}
+	for path, blob := range a.Files {
+		if b.Files[path] != blob || !sameMode(a, b, path) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMode reports whether path has the same mode in both snapshots; a
+// snapshot that predates modes matches any
+func sameMode(a, b fileSnapshot, path string) bool {
+	if a.Modes == nil || b.Modes == nil {
+		return true
+	}
+	return a.Modes[path] == b.Modes[path]
+}
+
+func getOplogFilePath() (string, error) {
+	return stickdir.File(constants.OPLOG_FILE)
+}
+
+func getOplogHeadPath() (string, error) {
+	return stickdir.File(constants.OPLOG_HEAD_FILE)
+}
+
+// readOplog returns every recorded operation, oldest first. A line torn by
+// a crash while appending is ignored.
+func readOplog() ([]Operation, error) {
+	path, err := getOplogFilePath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ops []Operation
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		var op Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// DefaultOplogExpiry is how long stick gc keeps operations to undo
+const DefaultOplogExpiry = 30 * 24 * time.Hour
+
+// expireOperations drops the operations recorded before cutoff, keeping the
+// one the current state comes from, and returns the rest and how many went
+func expireOperations(ops []Operation, head string, cutoff time.Time) ([]Operation, int) {
+	var kept []Operation
+	for _, op := range ops {
+		if op.CreatedAt.Before(cutoff) && op.ID != head {
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept, len(ops) - len(kept)
+}
+
+// writeOplog replaces the operation log with ops
+func writeOplog(ops []Operation) error {
+	path, err := getOplogFilePath()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		data, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	return stickdir.WriteFileAtomic(path, buf.Bytes(), 0644)
+}
+
+func appendOperation(op Operation) error {
+	path, err := getOplogFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readOplogHead returns the ID of the operation the current state comes from
+func readOplogHead() (string, error) {
+	path, err := getOplogHeadPath()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+func writeOplogHead(id string) error {
+	path, err := getOplogHeadPath()
+	if err != nil {
+		return err
+	}
+	return stickdir.WriteFileAtomic(path, []byte(id+"\n"), 0644)
+}
+
+func findOperation(ops []Operation, id string) *Operation {
+	for i := range ops {
+		if ops[i].ID == id {
+			return &ops[i]
+		}
+	}
+	return nil
+}
+
+// restoreOperationPoint puts the state and files back to a recorded point.
+// Unless force is set it refuses when files were edited since the point
+// stick believes the working tree is at.
+func restoreOperationPoint(rawState json.RawMessage, files, expected fileSnapshot, force bool) error {
+	if !force {
+		paths := make([]string, 0, len(expected.Files))
+		for path := range expected.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		current, err := snapshotFiles(paths, false)
+		if err != nil {
+			return err
+		}
+		var changed []string
+		for _, path := range paths {
+			if current.Files[path] != expected.Files[path] || !sameMode(current, expected, path) {
+				changed = append(changed, path)
+			}
+		}
+		if len(changed) > 0 {
+			return &DirtyStateError{Message: fmt.Sprintf("files changed since that operation: %s (use --force to overwrite)", strings.Join(changed, ", "))}
+		}
+	}
+
+	restored, _, err := decodeState(rawState)
+	if err != nil {
+		return err
+	}
+	if restored.Branches == nil {
+		restored.Branches = make(map[string]*VirtualBranch)
+	}
+	restored.WorkingDir = getCurrentDir()
+	restored.GitRoot = getGitRoot()
+
+	for path, blob := range files.Files {
+		if blob == "" {
+			if err := os.Remove(worktreePath(path)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		content, err := getBlobContent(blob)
+		if err != nil {
+			return err
+		}
+		if mode := files.Modes[path]; mode != "" {
+			err = writeFileMode(path, content, mode)
+		} else {
+			err = writeWorkingFile(path, content)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	state = restored
+	return saveState()
+}
@@ -0,0 +1,317 @@
+package vbranch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// OutputSchemaVersion is the version of the documents printed with --json
+// and fed to --format templates. It is bumped whenever a field is removed
+// or changes meaning; new fields may appear without a bump.
+const OutputSchemaVersion = 1
+
+// Output is the document every command prints in JSON mode
+type Output struct {
+	SchemaVersion int      `json:"schema_version"`
+	Command       string   `json:"command"`
+	OK            bool     `json:"ok"`
+	Error         string   `json:"error,omitempty"`
+	ErrorKind     string   `json:"error_kind,omitempty"`
+	Messages      []string `json:"messages,omitempty"`
+	Data          any      `json:"data,omitempty"`
+}
+
+// BranchOutput describes a virtual branch
+type BranchOutput struct {
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	Current      bool         `json:"current"`
+	Active       bool         `json:"active"`
+	BaseCommit   string       `json:"base_commit"`
+	BaseRef      string       `json:"base_ref,omitempty"`
+	GitBranch    string       `json:"git_branch,omitempty"`
+	PushedCommit string       `json:"pushed_commit,omitempty"`
+	PushedAt     *time.Time   `json:"pushed_at,omitempty"`
+	Files        []string     `json:"files"`
+	DeletedFiles []string     `json:"deleted_files"`
+	Hunks        []HunkOutput `json:"hunks"`
+	Stale        *Staleness   `json:"stale,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// HunkOutput describes one hunk of a virtual branch
+type HunkOutput struct {
+	ID         string `json:"id"`
+	File       string `json:"file"`
+	Type       string `json:"type"`
+	OldStart   int    `json:"old_start"`
+	OldLines   int    `json:"old_lines"`
+	NewStart   int    `json:"new_start"`
+	NewLines   int    `json:"new_lines"`
+	Content    string `json:"content"`
+	Conflicted bool   `json:"conflicted"`
+	OldFile    string `json:"old_file,omitempty"`
+	Binary     bool   `json:"binary"`
+	OldBlob    string `json:"old_blob,omitempty"`
+	NewBlob    string `json:"new_blob,omitempty"`
+	OldMode    string `json:"old_mode,omitempty"`
+	NewMode    string `json:"new_mode,omitempty"`
+}
+
+// StatusOutput is the data of stick status
+type StatusOutput struct {
+	GitRoot     string              `json:"git_root"`
+	GitBranch   string              `json:"git_branch"`
+	Uncommitted []string            `json:"uncommitted"`
+	Changes     []StatusEntryOutput `json:"changes"`
+	Branches    []BranchOutput      `json:"branches"`
+}
+
+// StatusEntryOutput describes one uncommitted change reported by git
+type StatusEntryOutput struct {
+	Path      string `json:"path"`
+	OrigPath  string `json:"orig_path,omitempty"`
+	Index     string `json:"index"`
+	Worktree  string `json:"worktree"`
+	Untracked bool   `json:"untracked"`
+	Unmerged  bool   `json:"unmerged"`
+	Submodule bool   `json:"submodule"`
+}
+
+// DiffFileOutput is one file of stick diff
+type DiffFileOutput struct {
+	File    string       `json:"file"`
+	OldFile string       `json:"old_file,omitempty"`
+	Type    string       `json:"type"`
+	Binary  bool         `json:"binary"`
+	OldSize int64        `json:"old_size,omitempty"`
+	NewSize int64        `json:"new_size,omitempty"`
+	OldMode string       `json:"old_mode,omitempty"`
+	NewMode string       `json:"new_mode,omitempty"`
+	Added   int          `json:"added"`
+	Removed int          `json:"removed"`
+	Hunks   []HunkOutput `json:"hunks"`
+}
+
+// DiffOutput is the data of stick diff
+type DiffOutput struct {
+	Branch     string           `json:"branch"`
+	Files      []DiffFileOutput `json:"files"`
+	Conflicted []HunkOutput     `json:"conflicted"`
+}
+
+// ConflictsOutput is the data of stick apply and unapply
+type ConflictsOutput struct {
+	Branch    string         `json:"branch"`
+	Conflicts []HunkConflict `json:"conflicts"`
+}
+
+// RebaseOutput is the result of rebasing one branch
+type RebaseOutput struct {
+	Branch    string         `json:"branch"`
+	Onto      string         `json:"onto"`
+	Skipped   bool           `json:"skipped"`
+	Clean     int            `json:"clean"`
+	Upstream  []string       `json:"upstream"`
+	Conflicts []HunkConflict `json:"conflicts"`
+}
+
+// OperationOutput describes an entry of the operation log
+type OperationOutput struct {
+	ID        string    `json:"id"`
+	Parent    string    `json:"parent"`
+	Command   string    `json:"command"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []string  `json:"files"`
+	Head      bool      `json:"head"`
+}
+
+// GCOutput is the data of stick gc
+type GCOutput struct {
+	Kept        int   `json:"kept"`
+	Pruned      int   `json:"pruned"`
+	Expired     int   `json:"expired"`
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// output collects what a command reports when printing structured output
+var output struct {
+	json     bool
+	template *template.Template
+	messages []string
+	err      error
+	data     any
+}
+
+// SetOutputFormat selects JSON output, a Go template over the JSON
+// document, or, when neither is given, the human-readable text
+func SetOutputFormat(jsonOutput bool, format string) error {
+	output.json = jsonOutput
+	if format == "" {
+		return nil
+	}
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid --format template: %v", err)
+	}
+	output.template = tmpl
+	return nil
+}
+
+// Structured reports whether the command output goes out as a document
+func Structured() bool {
+	return output.json || output.template != nil
+}
+
+// say reports progress: printed as a line of text, or kept as a message
+// of the structured document
+func say(format string, args ...any) {
+	if !Structured() {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	output.messages = append(output.messages, fmt.Sprintf(format, args...))
+}
+
+// emit sets the data of the structured document
+func emit(data any) {
+	output.data = data
+}
+
+// Fail records why the command did not complete, for the structured
+// document; in text mode the error is left to the caller to print
+func Fail(err error) {
+	output.err = err
+}
+
+// progressWriter is where output of child processes goes: the terminal in
+// text mode, stderr when stdout carries a document
+func progressWriter() io.Writer {
+	if Structured() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// FlushOutput prints the structured document for command, if one is due
+func FlushOutput(command string) error {
+	if !Structured() {
+		return nil
+	}
+	doc := Output{
+		SchemaVersion: OutputSchemaVersion,
+		Command:       command,
+		OK:            output.err == nil,
+		Messages:      output.messages,
+		Data:          output.data,
+	}
+	if output.err != nil {
+		doc.Error = output.err.Error()
+		doc.ErrorKind = ErrorKind(output.err)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output.template == nil {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	// templates see the document as JSON, so they use the documented keys
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if err := output.template.Execute(&sb, generic); err != nil {
+		return fmt.Errorf("executing --format template: %v", err)
+	}
+	fmt.Print(sb.String())
+	return nil
+}
+
+// branchOutput converts a branch into its documented form
+func branchOutput(branch *VirtualBranch) BranchOutput {
+	out := BranchOutput{
+		ID:           branch.ID,
+		Name:         branch.Name,
+		Description:  branch.Description,
+		Current:      branch.ID == state.CurrentBranch,
+		Active:       branch.Active,
+		BaseCommit:   branch.BaseCommit,
+		BaseRef:      branch.BaseRef,
+		GitBranch:    branch.GitBranch,
+		PushedCommit: branch.PushedCommit,
+		Files:        []string{},
+		DeletedFiles: []string{},
+		Hunks:        []HunkOutput{},
+		CreatedAt:    branch.CreatedAt,
+		UpdatedAt:    branch.UpdatedAt,
+	}
+	if !branch.PushedAt.IsZero() {
+		pushedAt := branch.PushedAt
+		out.PushedAt = &pushedAt
+	}
+	for filename := range branch.Files {
+		out.Files = append(out.Files, filename)
+	}
+	sort.Strings(out.Files)
+	out.DeletedFiles = append(out.DeletedFiles, branch.DeletedFiles...)
+	for _, i := range laneHunks(branch) {
+		out.Hunks = append(out.Hunks, hunkOutput(branch.Hunks[i]))
+	}
+	return out
+}
+
+// statusEntryOutput converts a git status entry into its documented form
+func statusEntryOutput(entry StatusEntry) StatusEntryOutput {
+	code := entry.Code()
+	return StatusEntryOutput{
+		Path:      entry.Path,
+		OrigPath:  entry.OrigPath,
+		Index:     code[:1],
+		Worktree:  code[1:],
+		Untracked: entry.Kind == '?',
+		Unmerged:  entry.Kind == 'u',
+		Submodule: entry.IsSubmodule(),
+	}
+}
+
+// hunkOutput converts a hunk into its documented form
+func hunkOutput(hunk Hunk) HunkOutput {
+	return HunkOutput{
+		ID:         hunk.ID,
+		File:       hunk.File,
+		Type:       hunk.Type,
+		OldStart:   hunk.OldStart,
+		OldLines:   hunk.OldLines,
+		NewStart:   hunk.NewStart,
+		NewLines:   hunk.NewLines,
+		Content:    hunk.Content,
+		Conflicted: hunk.Conflicted,
+		OldFile:    hunk.OldFile,
+		Binary:     hunk.Binary,
+		OldBlob:    hunk.OldBlob,
+		NewBlob:    hunk.NewBlob,
+		OldMode:    hunk.OldMode,
+		NewMode:    hunk.NewMode,
+	}
+}
+
+// PrintDocument prints data as the structured document of a command that
+// does not go through the state lock
+func PrintDocument(command string, data any) {
+	emit(data)
+	if err := FlushOutput(command); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
@@ -0,0 +1,231 @@
+package vbranch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tesh254/stick/internal/diff"
+)
+
+// patch converts a stored hunk back into a diff hunk
+func (h Hunk) patch() (diff.Hunk, error) {
+	lines, err := diff.ParseBody(h.Content)
+	if err != nil {
+		return diff.Hunk{}, fmt.Errorf("hunk %s: %v", h.ID, err)
+	}
+	return diff.Hunk{
+		OldStart: h.OldStart,
+		OldLines: h.OldLines,
+		NewStart: h.NewStart,
+		NewLines: h.NewLines,
+		Lines:    lines,
+	}, nil
+}
+
+// hunksByFile groups a branch's hunks per file, returning the files in a
+// stable order. Hunks left conflicted by a rebase are not included, nor are
+// renames and copies, which span two files (see renameHunks), or binary
+// changes, which have no lines (see binaryHunks).
+func hunksByFile(branch *VirtualBranch) ([]string, map[string][]Hunk) {
+	grouped := make(map[string][]Hunk)
+	var files []string
+	for _, hunk := range branch.Hunks {
+		if hunk.Conflicted || hunk.isRename() || hunk.Binary || hunk.isMode() {
+			continue
+		}
+		if _, seen := grouped[hunk.File]; !seen {
+			files = append(files, hunk.File)
+		}
+		grouped[hunk.File] = append(grouped[hunk.File], hunk)
+	}
+	sort.Strings(files)
+	return files, grouped
+}
+
+// getHeadBlob returns the blob ID of filename at HEAD, or "" if it is not there
+func getHeadBlob(filename string) string {
+	return getBlobAt("HEAD", filename)
+}
+
+// getBlobContent reads a blob from the Git object database
+func getBlobContent(blob string) (string, error) {
+	cmd := gitCommand("cat-file", "blob", blob)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("reading blob %s: %v", blob, err)
+	}
+	return string(output), nil
+}
+
+// getBlobAt returns the blob ID of filename in commit, or "" if it is not there
+func getBlobAt(commit, filename string) string {
+	blob, err := runGit(nil, "", "rev-parse", "--verify", "--quiet", commit+":"+filename)
+	if err != nil {
+		return ""
+	}
+	return blob
+}
+
+// getBaseBlob returns the blob the branch's hunks for filename were
+// recorded against, or "" if the file was new
+func getBaseBlob(branch *VirtualBranch, filename string) string {
+	if blob, recorded := branch.BaseBlobs[filename]; recorded {
+		return blob
+	}
+	if branch.BaseCommit != "" {
+		return getBlobAt(branch.BaseCommit, filename)
+	}
+	return getHeadBlob(filename)
+}
+
+// getBaseContent returns the version of filename the branch's hunks were recorded against
+func getBaseContent(branch *VirtualBranch, filename string) (string, error) {
+	blob := getBaseBlob(branch, filename)
+	if blob == "" {
+		return "", nil
+	}
+	return getBlobContent(blob)
+}
+
+// readWorkingFile returns the working tree content of filename and whether
+// it exists. A symlink is not followed; its content is its target, as in Git.
+func readWorkingFile(filename string) (string, bool, error) {
+	path := worktreePath(filename)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return target, err == nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// writeWorkingFile writes content to filename, keeping the mode of an
+// existing file: a symlink is pointed at content rather than written through
+func writeWorkingFile(filename, content string) error {
+	path := worktreePath(filename)
+	info, err := os.Lstat(path)
+	if err != nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(content), 0644)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return writeFileMode(filename, content, modeSymlink)
+	}
+	return os.WriteFile(path, []byte(content), info.Mode().Perm())
+}
+
+// conflictsForHunks maps merge conflicts back to the hunks whose range they
+// touch. When reverse is set the merge base is the patched version, so the
+// hunks' new-side ranges are used.
+func conflictsForHunks(filename string, hunks []Hunk, conflicts []diff.Conflict, reverse bool) []HunkConflict {
+	var out []HunkConflict
+	for _, hunk := range hunks {
+		first, count := hunk.OldStart, hunk.OldLines
+		if reverse {
+			first, count = hunk.NewStart, hunk.NewLines
+		}
+		start, end := first-1, first-1+count
+		if count == 0 {
+			start, end = first, first
+		}
+		for _, c := range conflicts {
+			if c.BaseStart <= end && start <= c.BaseEnd {
+				out = append(out, HunkConflict{
+					HunkID:    hunk.ID,
+					File:      filename,
+					StartLine: hunk.NewStart,
+					EndLine:   hunk.NewStart + hunk.NewLines - 1,
+				})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// patchFile replays hunks onto the working tree copy of filename, or takes
+// them back out when reverse is set. Hunks are patched in place first; if
+// any of them no longer fit, the file is three-way merged against the
+// recorded base so edits that belong to other branches survive.
+func patchFile(branch *VirtualBranch, filename string, hunks []Hunk, reverse bool) ([]HunkConflict, error) {
+	patches := make([]diff.Hunk, 0, len(hunks))
+	for _, hunk := range hunks {
+		p, err := hunk.patch()
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, p)
+	}
+
+	current, exists, err := readWorkingFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	toApply := patches
+	if reverse {
+		toApply = make([]diff.Hunk, len(patches))
+		for i, p := range patches {
+			toApply[i] = p.Reverse()
+		}
+	}
+
+	result, failed := diff.Apply(diff.SplitLines(current), toApply)
+	var conflicts []HunkConflict
+	if len(failed) > 0 {
+		base, err := getBaseContent(branch, filename)
+		if err != nil {
+			return nil, err
+		}
+		baseLines := diff.SplitLines(base)
+		patched, stale := diff.Apply(baseLines, patches)
+		if len(stale) > 0 {
+			return nil, fmt.Errorf("hunks for %s no longer match their recorded base", filename)
+		}
+		var merged []diff.Conflict
+		if reverse {
+			result, merged = diff.Merge3(patched, diff.SplitLines(current), baseLines)
+		} else {
+			result, merged = diff.Merge3(baseLines, diff.SplitLines(current), patched)
+		}
+		conflicts = conflictsForHunks(filename, hunks, merged, reverse)
+	}
+
+	// the file goes away when the change being replayed is its removal,
+	// or when taking back the change that created it
+	removes := "remove"
+	if reverse {
+		removes = "add"
+	}
+
+	content := strings.Join(result, "")
+	if content == current && exists {
+		return conflicts, nil
+	}
+	if content == "" && hunks[0].Type == removes {
+		if err := os.Remove(worktreePath(filename)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return conflicts, nil
+	}
+	if !exists {
+		// the file comes back with the mode it was added or removed with
+		mode := hunks[0].NewMode
+		if reverse {
+			mode = hunks[0].OldMode
+		}
+		return conflicts, writeFileMode(filename, content, orRegular(mode))
+	}
+	return conflicts, writeWorkingFile(filename, content)
+}
@@ -0,0 +1,233 @@
+package vbranch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tesh254/stick/internal/diff"
+)
+
+// RebaseResult summarises what rebasing one branch did
+type RebaseResult struct {
+	Clean     int            // hunks carried onto the new base
+	Upstream  []string       // files whose changes are already in the new base
+	Conflicts []HunkConflict // hunks left for the user to resolve
+}
+
+// conflictedHunks returns the hunks a rebase could not carry over
+func conflictedHunks(branch *VirtualBranch) []Hunk {
+	var out []Hunk
+	for _, hunk := range branch.Hunks {
+		if hunk.Conflicted {
+			out = append(out, hunk)
+		}
+	}
+	return out
+}
+
+// resolveCommit turns a revision into the full ID of the commit it names
+func resolveCommit(ref string) (string, error) {
+	commit, err := runGit(nil, "", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil || commit == "" {
+		return "", fmt.Errorf("'%s' does not name a commit", ref)
+	}
+	return commit, nil
+}
+
+// rebaseBranch re-records the branch's hunks against onto. Each file is
+// three-way merged between its old base, onto and the branch's version;
+// hunks that merge cleanly are re-derived against onto, while hunks that
+// collide with upstream changes keep their old form and are marked
+// conflicted. Only the stored state changes, never the working tree.
+func rebaseBranch(branch *VirtualBranch, onto string) (*RebaseResult, error) {
+	result := &RebaseResult{}
+	if branch.BaseBlobs == nil {
+		branch.BaseBlobs = make(map[string]string)
+	}
+	if branch.Files == nil {
+		branch.Files = make(map[string]string)
+	}
+
+	files, grouped := hunksByFile(branch)
+	rebased := make(map[string][]Hunk)
+	for _, filename := range files {
+		hunks := grouped[filename]
+		oldBlob := getBaseBlob(branch, filename)
+		ontoBlob := getBlobAt(onto, filename)
+		if oldBlob == ontoBlob {
+			rebased[filename] = hunks
+			result.Clean += len(hunks)
+			continue
+		}
+
+		base, err := getBaseContent(branch, filename)
+		if err != nil {
+			return nil, err
+		}
+		upstream := ""
+		if ontoBlob != "" {
+			if upstream, err = getBlobContent(ontoBlob); err != nil {
+				return nil, err
+			}
+		}
+
+		patches := make([]diff.Hunk, 0, len(hunks))
+		for _, hunk := range hunks {
+			p, err := hunk.patch()
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, p)
+		}
+		baseLines := diff.SplitLines(base)
+		lane, stale := diff.Apply(baseLines, patches)
+		if len(stale) > 0 {
+			return nil, fmt.Errorf("hunks for %s no longer match their recorded base", filename)
+		}
+
+		merged, collisions := diff.Merge3(baseLines, diff.SplitLines(upstream), lane)
+		conflicts := conflictsForHunks(filename, hunks, collisions, false)
+		conflicting := make(map[string]bool)
+		for _, c := range conflicts {
+			conflicting[c.HunkID] = true
+		}
+
+		for _, hunk := range hunks {
+			if conflicting[hunk.ID] {
+				hunk.Conflicted = true
+				hunk.ConflictBase = oldBlob
+				rebased[filename] = append(rebased[filename], hunk)
+			}
+		}
+		result.Conflicts = append(result.Conflicts, conflicts...)
+
+		content := strings.Join(merged, "")
+		hunkType := "modify"
+		if ontoBlob == "" {
+			hunkType = "add"
+		} else if content == "" && hunks[0].Type == "remove" {
+			hunkType = "remove"
+		}
+		clean := buildHunks(filename, upstream, content, hunkType)
+		if len(clean) == 0 && len(conflicts) == 0 {
+			result.Upstream = append(result.Upstream, filename)
+		}
+		rebased[filename] = append(rebased[filename], clean...)
+		result.Clean += len(clean)
+
+		branch.BaseBlobs[filename] = ontoBlob
+		removeDeletedFile(branch, filename)
+		delete(branch.Files, filename)
+		switch {
+		case len(clean) == 0:
+		case hunkType == "remove":
+			branch.DeletedFiles = append(branch.DeletedFiles, filename)
+		default:
+			if err := setFileContent(branch, filename, content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, hunk := range binaryHunks(branch) {
+		ontoBlob := getBlobAt(onto, hunk.File)
+		switch {
+		case ontoBlob == getBaseBlob(branch, hunk.File):
+			result.Clean++
+		case ontoBlob == hunk.NewBlob:
+			result.Upstream = append(result.Upstream, hunk.File)
+			delete(branch.Files, hunk.File)
+			removeDeletedFile(branch, hunk.File)
+			continue
+		default:
+			// binary content cannot be merged
+			hunk.Conflicted = true
+			hunk.ConflictBase = getBaseBlob(branch, hunk.File)
+			result.Conflicts = append(result.Conflicts, HunkConflict{HunkID: hunk.ID, File: hunk.File})
+		}
+		rebased[hunk.File] = []Hunk{hunk}
+	}
+
+	for _, hunk := range renameHunks(branch) {
+		carried, conflicted, upstream, err := rebaseRename(branch, hunk, onto)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case upstream:
+			result.Upstream = append(result.Upstream, hunk.File)
+			delete(branch.Files, hunk.File)
+			removeDeletedFile(branch, hunk.OldFile)
+			continue
+		case conflicted:
+			result.Conflicts = append(result.Conflicts, HunkConflict{
+				HunkID:    hunk.ID,
+				File:      hunk.File,
+				StartLine: hunk.NewStart,
+				EndLine:   hunk.NewStart + hunk.NewLines - 1,
+			})
+		default:
+			result.Clean++
+		}
+		rebased[hunk.File] = []Hunk{carried}
+	}
+
+	// a mode change carries over while onto still has the old mode; a
+	// renamed file's old mode is its source's
+	sources := make(map[string]string)
+	for _, hunk := range renameHunks(branch) {
+		sources[hunk.File] = hunk.OldFile
+	}
+	for _, hunk := range modeHunks(branch) {
+		filename := hunk.File
+		if source, renamed := sources[filename]; renamed {
+			filename = source
+		}
+		ontoMode, ontoBlob := treeBlob(onto, filename)
+		switch {
+		case ontoBlob != "" && ontoMode == hunk.OldMode:
+			result.Clean++
+		case ontoBlob != "" && ontoMode == hunk.NewMode:
+			if !slices.Contains(result.Upstream, hunk.File) {
+				result.Upstream = append(result.Upstream, hunk.File)
+			}
+			continue
+		default:
+			hunk.Conflicted = true
+			result.Conflicts = append(result.Conflicts, HunkConflict{HunkID: hunk.ID, File: hunk.File})
+		}
+		rebased[hunk.File] = append(rebased[hunk.File], hunk)
+	}
+
+	// rebuild the hunk list in its original file order, keeping hunks
+	// already conflicted by an earlier rebase
+	var hunks []Hunk
+	seen := make(map[string]bool)
+	for _, hunk := range branch.Hunks {
+		if hunk.Conflicted {
+			hunks = append(hunks, hunk)
+			continue
+		}
+		if !seen[hunk.File] {
+			seen[hunk.File] = true
+			hunks = append(hunks, rebased[hunk.File]...)
+		}
+	}
+	branch.Hunks = hunks
+	branch.BaseCommit = onto
+	branch.UpdatedAt = time.Now()
+	return result, nil
+}
+
+// removeDeletedFile drops filename from the branch's deleted files
+func removeDeletedFile(branch *VirtualBranch, filename string) {
+	kept := branch.DeletedFiles[:0]
+	for _, deleted := range branch.DeletedFiles {
+		if deleted != filename {
+			kept = append(kept, deleted)
+		}
+	}
+	branch.DeletedFiles = kept
+}
@@ -0,0 +1,446 @@
+package vbranch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tesh254/stick/internal/diff"
+	"github.com/tesh254/stick/internal/stickdir"
+)
+
+// DefaultRenameThreshold is how similar, in percent, a new file must be to
+// an old one to be recorded as its rename or copy, as with git's -M
+const DefaultRenameThreshold = 50
+
+// renameThreshold is the similarity used by this run; 0 turns detection off
+var renameThreshold = DefaultRenameThreshold
+
+// setRenameThreshold sets the similarity renames and copies are detected at
+func setRenameThreshold(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("rename threshold must be between 0 and 100, got %d", percent)
+	}
+	renameThreshold = percent
+	return nil
+}
+
+// renamePair is a file git considers renamed or copied in the working tree
+type renamePair struct {
+	Kind   string // "rename" or "copy"
+	Source string
+	Dest   string
+}
+
+// detectedRenames caches detectRenames for the run: the commands that look
+// for renames read the working tree but do not change it
+var detectedRenames []renamePair
+var renamesDetected bool
+
+// detectRenames asks git which working tree files are renames or copies of
+// files at HEAD. The working tree is staged into a throwaway copy of the
+// index so the real one is never touched.
+func detectRenames() ([]renamePair, error) {
+	if renamesDetected {
+		return detectedRenames, nil
+	}
+	if renameThreshold == 0 {
+		renamesDetected = true
+		return nil, nil
+	}
+	if _, err := getHeadCommit(); err != nil {
+		// nothing to rename from before the first commit
+		renamesDetected = true
+		return nil, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "stick-index-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	index := filepath.Join(tmpDir, "index")
+	env := []string{"GIT_INDEX_FILE=" + index}
+
+	// start from the real index so unchanged files need not be rehashed
+	realIndex, err := runGit(nil, "", "rev-parse", "--git-path", "index")
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(realIndex) {
+		realIndex = filepath.Join(state.GitRoot, realIndex)
+	}
+	if data, err := os.ReadFile(realIndex); err == nil {
+		if err := os.WriteFile(index, data, 0644); err != nil {
+			return nil, err
+		}
+	} else if _, err := runGit(env, "", "read-tree", "HEAD"); err != nil {
+		return nil, err
+	}
+	if _, err := runGit(env, "", "add", "--all", "--", "."); err != nil {
+		return nil, err
+	}
+
+	threshold := strconv.Itoa(renameThreshold) + "%"
+	cmd := gitCommand("diff-index", "--cached", "-z", "--name-status", "--find-renames="+threshold, "--find-copies="+threshold, "HEAD")
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("detecting renames: %v", err)
+	}
+
+	var pairs []renamePair
+	fields := bytes.Split(output, []byte{0})
+	for i := 0; i < len(fields); i++ {
+		status := string(fields[i])
+		if status == "" {
+			continue
+		}
+		if status[0] != 'R' && status[0] != 'C' {
+			i++ // a single path follows
+			continue
+		}
+		if i+2 >= len(fields) {
+			return nil, fmt.Errorf("malformed rename entry %q", status)
+		}
+		pair := renamePair{Kind: "rename", Source: string(fields[i+1]), Dest: string(fields[i+2])}
+		if status[0] == 'C' {
+			pair.Kind = "copy"
+		}
+		i += 2
+		if !stickdir.IsLegacyPath(pair.Source) && !stickdir.IsLegacyPath(pair.Dest) {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	detectedRenames, renamesDetected = pairs, true
+	return pairs, nil
+}
+
+// findRename returns the rename or copy filename is part of, or nil. The
+// source of a copy is left out: it is still there and may change on its own.
+func findRename(filename string) (*renamePair, error) {
+	pairs, err := detectRenames()
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		if pair.Dest == filename || (pair.Kind == "rename" && pair.Source == filename) {
+			return &pair, nil
+		}
+	}
+	return nil, nil
+}
+
+// isRename reports whether the hunk renames or copies a file rather than
+// editing one in place
+func (h Hunk) isRename() bool {
+	return h.OldFile != ""
+}
+
+// renameHunks returns the branch's rename and copy hunks, leaving out those
+// left conflicted by a rebase
+func renameHunks(branch *VirtualBranch) []Hunk {
+	var out []Hunk
+	for _, hunk := range branch.Hunks {
+		if hunk.isRename() && !hunk.Conflicted {
+			out = append(out, hunk)
+		}
+	}
+	return out
+}
+
+// wholeFileHunk is a single hunk that turns old into new, keeping every
+// unchanged line as context so it only applies to that exact source
+func wholeFileHunk(old, new string) diff.Hunk {
+	a, b := diff.SplitLines(old), diff.SplitLines(new)
+	h := diff.Hunk{OldLines: len(a), NewLines: len(b), Lines: diff.Lines(a, b)}
+	if len(a) > 0 {
+		h.OldStart = 1
+	}
+	if len(b) > 0 {
+		h.NewStart = 1
+	}
+	return h
+}
+
+// newRenameHunk records pair, with the content edits that turn the source's
+// base into current, as a single hunk
+func newRenameHunk(pair renamePair, base, current string, taken map[string]bool) Hunk {
+	hunk := newHunk(pair.Dest, wholeFileHunk(base, current), pair.Kind, taken)
+	hunk.OldFile = pair.Source
+	return hunk
+}
+
+// recordRename stores pair on branch as one rename hunk, replacing whatever
+// the branch held for either path
+func recordRename(branch *VirtualBranch, pair renamePair, dest fileVersion) error {
+	if err := checkRemoteBase(branch); err != nil {
+		return err
+	}
+	for _, other := range state.Branches {
+		if other.ID == branch.ID {
+			continue
+		}
+		for _, hunk := range other.Hunks {
+			if hunk.File == pair.Dest && hunk.OldFile == pair.Source {
+				return fmt.Errorf("the %s of %s to %s already belongs to virtual branch %s", pair.Kind, pair.Source, pair.Dest, other.Name)
+			}
+		}
+	}
+
+	base, _ := getHeadContent(pair.Source)
+	current := dest.Content
+	if !dest.Exists {
+		return fmt.Errorf("%s no longer exists", pair.Dest)
+	}
+
+	kept := branch.Hunks[:0]
+	for _, hunk := range branch.Hunks {
+		touches := hunk.File == pair.Dest || hunk.OldFile == pair.Dest
+		if pair.Kind == "rename" {
+			touches = touches || hunk.File == pair.Source || hunk.OldFile == pair.Source
+		}
+		if !touches {
+			kept = append(kept, hunk)
+		}
+	}
+	branch.Hunks = kept
+	delete(branch.Files, pair.Dest)
+	removeDeletedFile(branch, pair.Dest)
+	if pair.Kind == "rename" {
+		delete(branch.Files, pair.Source)
+		removeDeletedFile(branch, pair.Source)
+	}
+
+	if branch.BaseBlobs == nil {
+		branch.BaseBlobs = make(map[string]string)
+	}
+	if branch.Files == nil {
+		branch.Files = make(map[string]string)
+	}
+	branch.BaseBlobs[pair.Source] = getHeadBlob(pair.Source)
+	recordBaseCommit(branch)
+
+	taken := make(map[string]bool)
+	for _, hunk := range branch.Hunks {
+		taken[hunk.ID] = true
+	}
+	if isBinary(base) || isBinary(current) {
+		hunk, err := newBinaryHunk(pair.Dest, getHeadBlob(pair.Source), current, true, pair.Kind, taken)
+		if err != nil {
+			return err
+		}
+		hunk.OldFile = pair.Source
+		branch.Hunks = append(branch.Hunks, hunk)
+		branch.Files[pair.Dest] = hunk.NewBlob
+	} else {
+		branch.Hunks = append(branch.Hunks, newRenameHunk(pair, base, current, taken))
+		if err := setFileContent(branch, pair.Dest, current); err != nil {
+			return err
+		}
+	}
+	if pair.Kind == "rename" {
+		branch.DeletedFiles = append(branch.DeletedFiles, pair.Source)
+	}
+
+	// the destination starts out with the source's mode
+	if sourceMode := getHeadMode(pair.Source); sourceMode != dest.Mode {
+		recordMode(branch, pair.Dest, sourceMode, dest.Mode)
+	}
+	branch.UpdatedAt = time.Now()
+	return nil
+}
+
+// patchRename carries out a rename hunk in the working tree, or takes it
+// back when reverse is set. Edits made to the file since it was recorded
+// are three-way merged like those of any other hunk.
+func patchRename(branch *VirtualBranch, hunk Hunk, reverse bool) ([]HunkConflict, error) {
+	if hunk.Binary {
+		return patchBinary(hunk, reverse)
+	}
+	p, err := hunk.patch()
+	if err != nil {
+		return nil, err
+	}
+	source, sourceExists, err := readWorkingFile(hunk.OldFile)
+	if err != nil {
+		return nil, err
+	}
+	dest, destExists, err := readWorkingFile(hunk.File)
+	if err != nil {
+		return nil, err
+	}
+	renames := hunk.Type == "rename"
+
+	if !reverse {
+		switch {
+		case destExists && (!renames || !sourceExists):
+			return nil, nil // already applied
+		case destExists:
+			return nil, fmt.Errorf("cannot %s %s: %s already exists", hunk.Type, hunk.OldFile, hunk.File)
+		case renames && !sourceExists:
+			return nil, fmt.Errorf("cannot %s %s: it is gone from the working tree", hunk.Type, hunk.OldFile)
+		}
+		if !renames {
+			// a copy starts from the source as recorded, not from later
+			// edits to the source, which are not part of the copy
+			if source, err = getBaseContent(branch, hunk.OldFile); err != nil {
+				return nil, err
+			}
+		}
+		result, conflicts, err := mergeRename(branch, hunk, p, source, false)
+		if err != nil {
+			return nil, err
+		}
+		mode, _, err := worktreeMode(hunk.OldFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileMode(hunk.File, result, orRegular(mode)); err != nil {
+			return nil, err
+		}
+		if renames {
+			if err := os.Remove(worktreePath(hunk.OldFile)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		return conflicts, nil
+	}
+
+	switch {
+	case !destExists:
+		return nil, nil // already taken back
+	case renames && sourceExists:
+		return nil, fmt.Errorf("cannot take back the rename of %s: it exists again", hunk.OldFile)
+	}
+	result, conflicts, err := mergeRename(branch, hunk, p, dest, true)
+	if err != nil {
+		return nil, err
+	}
+	if renames {
+		mode, _, err := worktreeMode(hunk.File)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileMode(hunk.OldFile, result, orRegular(mode)); err != nil {
+			return nil, err
+		}
+	} else if len(conflicts) > 0 {
+		// the copy was edited since; removing it would lose those edits
+		return conflicts, nil
+	}
+	if err := os.Remove(worktreePath(hunk.File)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// mergeRename applies the rename hunk's edits to current, the source's
+// working tree content, or takes them back out of the destination's when
+// reverse is set, falling back to a three-way merge against the base
+func mergeRename(branch *VirtualBranch, hunk Hunk, p diff.Hunk, current string, reverse bool) (string, []HunkConflict, error) {
+	toApply := p
+	if reverse {
+		toApply = p.Reverse()
+	}
+	result, failed := diff.Apply(diff.SplitLines(current), []diff.Hunk{toApply})
+	if len(failed) == 0 {
+		return strings.Join(result, ""), nil, nil
+	}
+
+	base, err := getBaseContent(branch, hunk.OldFile)
+	if err != nil {
+		return "", nil, err
+	}
+	baseLines := diff.SplitLines(base)
+	patched, stale := diff.Apply(baseLines, []diff.Hunk{p})
+	if len(stale) > 0 {
+		return "", nil, fmt.Errorf("the %s of %s no longer matches its recorded base", hunk.Type, hunk.OldFile)
+	}
+	var merged []diff.Conflict
+	if reverse {
+		result, merged = diff.Merge3(patched, diff.SplitLines(current), baseLines)
+	} else {
+		result, merged = diff.Merge3(baseLines, diff.SplitLines(current), patched)
+	}
+	return strings.Join(result, ""), conflictsForHunks(hunk.File, []Hunk{hunk}, merged, reverse), nil
+}
+
+// rebaseRename carries a rename hunk onto onto, three-way merging its edits
+// with upstream changes to the source. It reports whether the hunk was
+// marked conflicted and whether upstream already holds the whole change.
+func rebaseRename(branch *VirtualBranch, hunk Hunk, onto string) (Hunk, bool, bool, error) {
+	oldBlob := getBaseBlob(branch, hunk.OldFile)
+	ontoBlob := getBlobAt(onto, hunk.OldFile)
+	if oldBlob == ontoBlob && getBlobAt(onto, hunk.File) == "" {
+		return hunk, false, false, nil
+	}
+	if hunk.Binary {
+		// binary content cannot be merged: either upstream made the same
+		// change, or it conflicts
+		if getBlobAt(onto, hunk.File) == hunk.NewBlob && (hunk.Type == "copy" || ontoBlob == "") {
+			return hunk, false, true, nil
+		}
+		hunk.Conflicted = true
+		hunk.ConflictBase = oldBlob
+		return hunk, true, false, nil
+	}
+
+	p, err := hunk.patch()
+	if err != nil {
+		return hunk, false, false, err
+	}
+	base, err := getBaseContent(branch, hunk.OldFile)
+	if err != nil {
+		return hunk, false, false, err
+	}
+	baseLines := diff.SplitLines(base)
+	lane, stale := diff.Apply(baseLines, []diff.Hunk{p})
+	if len(stale) > 0 {
+		return hunk, false, false, fmt.Errorf("the %s of %s no longer matches its recorded base", hunk.Type, hunk.OldFile)
+	}
+	content := strings.Join(lane, "")
+
+	conflicted := func() (Hunk, bool, bool, error) {
+		hunk.Conflicted = true
+		hunk.ConflictBase = oldBlob
+		return hunk, true, false, nil
+	}
+
+	// upstream may have made the same rename, or put another file there
+	if destBlob := getBlobAt(onto, hunk.File); destBlob != "" {
+		upstream, err := getBlobContent(destBlob)
+		if err != nil {
+			return hunk, false, false, err
+		}
+		if upstream == content && (hunk.Type == "copy" || ontoBlob == "") {
+			return hunk, false, true, nil
+		}
+		return conflicted()
+	}
+	if ontoBlob == "" {
+		return conflicted()
+	}
+
+	upstream, err := getBlobContent(ontoBlob)
+	if err != nil {
+		return hunk, false, false, err
+	}
+	merged, collisions := diff.Merge3(baseLines, diff.SplitLines(upstream), lane)
+	if len(collisions) > 0 {
+		return conflicted()
+	}
+
+	pair := renamePair{Kind: hunk.Type, Source: hunk.OldFile, Dest: hunk.File}
+	carried := newRenameHunk(pair, upstream, strings.Join(merged, ""), map[string]bool{})
+	branch.BaseBlobs[hunk.OldFile] = ontoBlob
+	if err := setFileContent(branch, hunk.File, strings.Join(merged, "")); err != nil {
+		return hunk, false, false, err
+	}
+	return carried, false, false, nil
+}
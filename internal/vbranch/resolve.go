@@ -0,0 +1,158 @@
+package vbranch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortedBranches returns the branches in the order `branch list` numbers them
+func sortedBranches() []*VirtualBranch {
+	branches := make([]*VirtualBranch, 0, len(state.Branches))
+	for _, branch := range state.Branches {
+		branches = append(branches, branch)
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		if !branches[i].CreatedAt.Equal(branches[j].CreatedAt) {
+			return branches[i].CreatedAt.Before(branches[j].CreatedAt)
+		}
+		if branches[i].Name != branches[j].Name {
+			return branches[i].Name < branches[j].Name
+		}
+		return branches[i].ID < branches[j].ID
+	})
+	return branches
+}
+
+// findBranchByName returns the branch with exactly this name, or nil
+func findBranchByName(name string) *VirtualBranch {
+	for _, branch := range state.Branches {
+		if branch.Name == name {
+			return branch
+		}
+	}
+	return nil
+}
+
+// resolveBranch finds a branch by exact name, by its number in `branch
+// list`, or by a unique prefix of its ID, in that order
+func resolveBranch(ref string) (*VirtualBranch, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("no virtual branch given")
+	}
+	if branch := findBranchByName(ref); branch != nil {
+		return branch, nil
+	}
+
+	if position, err := strconv.Atoi(ref); err == nil {
+		branches := sortedBranches()
+		if position >= 1 && position <= len(branches) {
+			return branches[position-1], nil
+		}
+	}
+
+	var matches []*VirtualBranch
+	for _, branch := range state.Branches {
+		if strings.HasPrefix(branch.ID, ref) {
+			matches = append(matches, branch)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, &BranchNotFoundError{Ref: ref}
+	case 1:
+		return matches[0], nil
+	}
+
+	names := make([]string, len(matches))
+	for i, branch := range matches {
+		names[i] = fmt.Sprintf("%s (%s)", branch.Name, branch.ID)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("'%s' is ambiguous, it matches: %s", ref, strings.Join(names, ", "))
+}
+
+// resolveBranchOrCurrent resolves ref, falling back to the current branch when it is nil
+func resolveBranchOrCurrent(ref *string) (*VirtualBranch, error) {
+	if ref != nil {
+		return resolveBranch(*ref)
+	}
+	branch, exists := state.Branches[state.CurrentBranch]
+	if !exists {
+		return nil, fmt.Errorf("no current virtual branch. Use 'stick branch switch' first")
+	}
+	return branch, nil
+}
+
+// validateBranchName checks that name is unused and can become a Git branch
+func validateBranchName(name string) error {
+	if name == "" {
+		return fmt.Errorf("branch name cannot be empty")
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("branch name '%s' would be confused with a position in 'branch list'", name)
+	}
+	if _, err := runGit(nil, "", "check-ref-format", "refs/heads/"+name); err != nil {
+		return fmt.Errorf("'%s' is not a valid branch name", name)
+	}
+	if findBranchByName(name) != nil {
+		return fmt.Errorf("branch '%s' already exists", name)
+	}
+	return nil
+}
+
+// minHunkIDLength is the shortest hunk ID prefix shown, like Git's abbreviations
+const minHunkIDLength = 7
+
+// shortHunkID abbreviates a hunk ID to the shortest prefix, no shorter than
+// minHunkIDLength, that no other hunk shares
+func shortHunkID(id string) string {
+	length := minHunkIDLength
+	for _, branch := range state.Branches {
+		for _, hunk := range branch.Hunks {
+			if hunk.ID == id {
+				continue
+			}
+			common := 0
+			for common < len(id) && common < len(hunk.ID) && id[common] == hunk.ID[common] {
+				common++
+			}
+			length = max(length, common+1)
+		}
+	}
+	return id[:min(length, len(id))]
+}
+
+// resolveHunk finds a hunk by a unique prefix of its ID, returning the
+// branch holding it and its index there
+func resolveHunk(ref string) (*VirtualBranch, int, error) {
+	if ref == "" {
+		return nil, 0, fmt.Errorf("no hunk given")
+	}
+
+	var branch *VirtualBranch
+	index := -1
+	var matches []string
+	for _, candidate := range state.Branches {
+		for i, hunk := range candidate.Hunks {
+			if !strings.HasPrefix(hunk.ID, ref) {
+				continue
+			}
+			if hunk.ID == ref {
+				return candidate, i, nil
+			}
+			branch, index = candidate, i
+			matches = append(matches, fmt.Sprintf("%s (%s in %s)", shortHunkID(hunk.ID), hunk.File, candidate.Name))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, 0, &HunkNotFoundError{Ref: ref}
+	case 1:
+		return branch, index, nil
+	}
+	sort.Strings(matches)
+	return nil, 0, fmt.Errorf("hunk '%s' is ambiguous, it matches: %s", ref, strings.Join(matches, ", "))
+}
@@ -0,0 +1,325 @@
+package vbranch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tesh254/stick/internal/constants"
+	"github.com/tesh254/stick/internal/metadata"
+	"github.com/tesh254/stick/internal/stickdir"
+)
+
+// SchemaVersion is the state file format this build reads and writes
+const SchemaVersion = 4
+
+// migration upgrades a raw state document from version from to from+1
+type migration struct {
+	from        int
+	description string
+	apply       func(doc map[string]any) error
+}
+
+// migrations must stay ordered by from, one step per schema version
+var migrations = []migration{
+	{from: 0, description: "version the state file and fold in legacy metadata.json", apply: migrateUnversioned},
+	{from: 1, description: "make virtual branch names unique", apply: migrateUniqueNames},
+	{from: 2, description: "derive hunk IDs from their content", apply: migrateHunkIDs},
+	{from: 3, description: "move file and hunk contents into the object database", apply: migrateBlobStore},
+}
+
+// schemaVersionOf reads the version of a raw state document; files written
+// before versioning have none and count as version 0
+func schemaVersionOf(doc map[string]any) int {
+	version, ok := doc["schema_version"].(float64)
+	if !ok {
+		return 0
+	}
+	return int(version)
+}
+
+// decodeState parses a state file, upgrading older schema versions. It
+// refuses files written by a newer stick rather than silently dropping
+// fields this build does not know about.
+func decodeState(data []byte) (*StickState, bool, error) {
+	doc := make(map[string]any)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, false, err
+		}
+	}
+
+	version := schemaVersionOf(doc)
+	if version > SchemaVersion {
+		return nil, false, fmt.Errorf("state file uses schema version %d but this stick only understands up to %d; upgrade stick to use this repository", version, SchemaVersion)
+	}
+
+	migrated := version < SchemaVersion
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		if err := m.apply(doc); err != nil {
+			return nil, false, fmt.Errorf("migrating state from schema version %d (%s): %v", m.from, m.description, err)
+		}
+		version = m.from + 1
+		doc["schema_version"] = version
+	}
+
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	loaded := &StickState{}
+	if err := json.Unmarshal(upgraded, loaded); err != nil {
+		return nil, false, err
+	}
+	if err := loadHunkContents(loaded); err != nil {
+		return nil, false, err
+	}
+	return loaded, migrated, nil
+}
+
+// backupState keeps a copy of a state file before it is rewritten in a newer schema
+func backupState(stateFile string, data []byte, version int) error {
+	backup := fmt.Sprintf("%s.v%d.bak", stateFile, version)
+	if _, err := os.Stat(backup); err == nil {
+		return nil
+	}
+	return stickdir.WriteFileSync(backup, data, 0644)
+}
+
+// getMetadataFilePath returns the legacy metadata file, or "" outside a repository
+func getMetadataFilePath() string {
+	metadataFile, err := stickdir.File(constants.METADATA_FILE)
+	if err != nil {
+		return ""
+	}
+	return metadataFile
+}
+
+// hasStoredState reports whether there is a state file, or legacy metadata
+// that should become one
+func hasStoredState() bool {
+	for _, path := range []string{getStateFilePath(), getMetadataFilePath()} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateUnversioned fills in collections older files may lack and turns
+// every branch from the separate metadata.json store into a virtual branch
+func migrateUnversioned(doc map[string]any) error {
+	branches, _ := doc["branches"].(map[string]any)
+	if branches == nil {
+		branches = make(map[string]any)
+		doc["branches"] = branches
+	}
+
+	names := make(map[string]bool)
+	for _, raw := range branches {
+		branch, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"files", "base_blobs"} {
+			if _, ok := branch[key].(map[string]any); !ok {
+				branch[key] = map[string]any{}
+			}
+		}
+		if _, ok := branch["hunks"].([]any); !ok {
+			branch["hunks"] = []any{}
+		}
+		if name, ok := branch["name"].(string); ok {
+			names[name] = true
+		}
+	}
+
+	metadataFile := getMetadataFilePath()
+	if metadataFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(metadataFile); err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	md := metadata.LoadMetadata()
+	for name, legacy := range md.VirtualBranches {
+		if names[name] {
+			continue
+		}
+		// same shape as generateID, offset so IDs made in one pass stay distinct
+		id := fmt.Sprintf("%d", now.UnixNano()+int64(len(branches)))
+		branches[id] = map[string]any{
+			"name":       name,
+			"id":         id,
+			"git_branch": legacy.GitBranch,
+			"files":      map[string]any{},
+			"base_blobs": map[string]any{},
+			"hunks":      []any{},
+			"created_at": now,
+			"updated_at": now,
+			"active":     false,
+		}
+	}
+
+	return nil
+}
+
+// persistMigration saves a freshly upgraded state, keeping a backup of the
+// old file and retiring legacy metadata.json once its branches are saved.
+// Must be called with the state lock held.
+func persistMigration(previous []byte) error {
+	if len(previous) > 0 {
+		doc := make(map[string]any)
+		json.Unmarshal(previous, &doc)
+		if err := backupState(getStateFilePath(), previous, schemaVersionOf(doc)); err != nil {
+			return fmt.Errorf("backing up state before migration: %v", err)
+		}
+	}
+	if err := saveState(); err != nil {
+		return err
+	}
+
+	metadataFile := getMetadataFilePath()
+	if _, err := os.Stat(metadataFile); err == nil {
+		return os.Rename(metadataFile, metadataFile+".migrated")
+	}
+	return nil
+}
+
+// migrateUniqueNames renames branches that share a name with an older
+// branch, since names now have to identify a branch on their own
+func migrateUniqueNames(doc map[string]any) error {
+	branches, _ := doc["branches"].(map[string]any)
+
+	type entry struct {
+		id, name, created string
+		branch            map[string]any
+	}
+	var entries []entry
+	for id, raw := range branches {
+		branch, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := branch["name"].(string)
+		created, _ := branch["created_at"].(string)
+		entries = append(entries, entry{id: id, name: name, created: created, branch: branch})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].created != entries[j].created {
+			return entries[i].created < entries[j].created
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	taken := make(map[string]bool)
+	for _, e := range entries {
+		taken[e.name] = true
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !seen[e.name] {
+			seen[e.name] = true
+			continue
+		}
+		name := e.name
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", e.name, n)
+		}
+		taken[name] = true
+		e.branch["name"] = name
+	}
+	return nil
+}
+
+// migrateHunkIDs replaces time-based hunk IDs with content-derived ones
+func migrateHunkIDs(doc map[string]any) error {
+	branches, _ := doc["branches"].(map[string]any)
+	ids := make([]string, 0, len(branches))
+	for id := range branches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	taken := make(map[string]bool)
+	for _, id := range ids {
+		branch, ok := branches[id].(map[string]any)
+		if !ok {
+			continue
+		}
+		hunks, _ := branch["hunks"].([]any)
+		for _, raw := range hunks {
+			hunk, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			file, _ := hunk["file"].(string)
+			content, _ := hunk["content"].(string)
+			newID := hunkID(file, content, taken)
+			taken[newID] = true
+			hunk["id"] = newID
+		}
+	}
+	return nil
+}
+
+// migrateBlobStore replaces inline file and hunk contents with the IDs of
+// blobs holding them. Binary files were recorded as "" and take the blob
+// their hunk writes.
+func migrateBlobStore(doc map[string]any) error {
+	branches, _ := doc["branches"].(map[string]any)
+	for _, raw := range branches {
+		branch, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		hunks, _ := branch["hunks"].([]any)
+		written := make(map[string]string)
+		for _, raw := range hunks {
+			hunk, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			if binary, _ := hunk["binary"].(bool); binary {
+				file, _ := hunk["file"].(string)
+				written[file], _ = hunk["new_blob"].(string)
+			}
+			delete(hunk, "context")
+			content, _ := hunk["content"].(string)
+			delete(hunk, "content")
+			if content == "" {
+				continue
+			}
+			blob, err := storeBlob(content)
+			if err != nil {
+				return err
+			}
+			hunk["content_blob"] = blob
+		}
+
+		files, _ := branch["files"].(map[string]any)
+		for filename, raw := range files {
+			content, _ := raw.(string)
+			if blob, ok := written[filename]; ok && content == "" {
+				files[filename] = blob
+				continue
+			}
+			blob, err := storeBlob(content)
+			if err != nil {
+				return err
+			}
+			files[filename] = blob
+		}
+	}
+	return nil
+}
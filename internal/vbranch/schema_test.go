@@ -0,0 +1,187 @@
+package vbranch
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tesh254/stick/internal/constants"
+)
+
+// newTestRepo makes an empty Git repository the current directory and
+// points the state at it
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, output)
+	}
+	t.Chdir(dir)
+
+	saved, savedKnown, savedPending := state, knownBlobs, pendingBlobs
+	t.Cleanup(func() {
+		state, knownBlobs, pendingBlobs = saved, savedKnown, savedPending
+	})
+	state = &StickState{Branches: make(map[string]*VirtualBranch), GitRoot: dir, WorkingDir: dir}
+	knownBlobs = make(map[string]string)
+	pendingBlobs = make(map[string]bool)
+	return dir
+}
+
+// writeStickFile writes one of stick's files into the repository's stick directory
+func writeStickFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, ".git", constants.STICK_DIR, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blobOf returns the blob ID git gives content
+func blobOf(t *testing.T, content string) string {
+	t.Helper()
+	blob, err := hashContent(content, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// branchNamed finds the branch called name
+func branchNamed(t *testing.T, s *StickState, name string) *VirtualBranch {
+	t.Helper()
+	for _, branch := range s.Branches {
+		if branch.Name == name {
+			return branch
+		}
+	}
+	t.Fatalf("no branch named %q", name)
+	return nil
+}
+
+func TestDecodeStateUnversioned(t *testing.T) {
+	dir := newTestRepo(t)
+	writeStickFile(t, dir, constants.METADATA_FILE, `{
+		"virtualBranches": {
+			"legacy": {"gitBranch": "stick/legacy", "files": []},
+			"feat": {"gitBranch": "stick/feat", "files": []}
+		}
+	}`)
+
+	loaded, migrated, err := decodeState([]byte(`{
+		"branches": {
+			"100": {
+				"name": "feat",
+				"id": "100",
+				"files": {"a.txt": "hello\n"},
+				"hunks": [{"id": "1700000000", "file": "a.txt", "type": "add", "content": "@@ -0,0 +1 @@\n+hello\n", "context": ""}],
+				"created_at": "2024-01-01T00:00:00Z",
+				"active": true
+			},
+			"200": {"name": "feat", "id": "200", "created_at": "2024-02-01T00:00:00Z"}
+		},
+		"current_branch": "100"
+	}`))
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	if !migrated {
+		t.Error("decodeState did not report a migration")
+	}
+	if len(loaded.Branches) != 3 {
+		t.Fatalf("got %d branches, want 3", len(loaded.Branches))
+	}
+	if loaded.CurrentBranch != "100" {
+		t.Errorf("current branch = %q, want 100", loaded.CurrentBranch)
+	}
+
+	// the older of two branches keeps the name
+	feat := loaded.Branches["100"]
+	if feat.Name != "feat" {
+		t.Errorf("older branch is named %q, want feat", feat.Name)
+	}
+	if renamed := loaded.Branches["200"]; renamed.Name != "feat-2" {
+		t.Errorf("newer branch is named %q, want feat-2", renamed.Name)
+	}
+	if empty := loaded.Branches["200"]; empty.Files == nil || empty.BaseBlobs == nil || empty.Hunks == nil {
+		t.Errorf("missing collections were not filled in: %+v", empty)
+	}
+
+	// contents now live in the object database
+	if got, want := feat.Files["a.txt"], blobOf(t, "hello\n"); got != want {
+		t.Errorf("files[a.txt] = %q, want blob %q", got, want)
+	}
+	hunk := feat.Hunks[0]
+	content := "@@ -0,0 +1 @@\n+hello\n"
+	if want := hunkID("a.txt", content, map[string]bool{}); hunk.ID != want {
+		t.Errorf("hunk ID = %q, want %q", hunk.ID, want)
+	}
+	if want := blobOf(t, content); hunk.ContentBlob != want {
+		t.Errorf("hunk content blob = %q, want %q", hunk.ContentBlob, want)
+	}
+	if hunk.Content != content {
+		t.Errorf("hunk content = %q, want %q", hunk.Content, content)
+	}
+
+	// metadata.json contributes only branches the state does not have
+	legacy := branchNamed(t, loaded, "legacy")
+	if legacy.GitBranch != "stick/legacy" || legacy.Active {
+		t.Errorf("legacy branch = %+v, want inactive on stick/legacy", legacy)
+	}
+}
+
+func TestDecodeStateBinaryBlob(t *testing.T) {
+	newTestRepo(t)
+	image := blobOf(t, "\x89PNG\x00")
+	loaded, _, err := decodeState([]byte(`{
+		"schema_version": 3,
+		"branches": {
+			"100": {
+				"name": "images",
+				"id": "100",
+				"files": {"logo.png": ""},
+				"base_blobs": {},
+				"hunks": [{"id": "abc", "file": "logo.png", "type": "add", "binary": true, "new_blob": "` + image + `"}]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	branch := loaded.Branches["100"]
+	if got := branch.Files["logo.png"]; got != image {
+		t.Errorf("binary file recorded as %q, want the blob its hunk writes, %q", got, image)
+	}
+	if branch.Hunks[0].ContentBlob != "" {
+		t.Errorf("binary hunk got a content blob %q", branch.Hunks[0].ContentBlob)
+	}
+}
+
+func TestDecodeStateCurrent(t *testing.T) {
+	newTestRepo(t)
+	loaded, migrated, err := decodeState([]byte(fmt.Sprintf(`{"schema_version": %d, "branches": {"1": {"name": "a", "id": "1"}}}`, SchemaVersion)))
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	if migrated {
+		t.Error("a current state file was reported as migrated")
+	}
+	if loaded.SchemaVersion != SchemaVersion {
+		t.Errorf("schema version = %d, want %d", loaded.SchemaVersion, SchemaVersion)
+	}
+}
+
+func TestDecodeStateNewer(t *testing.T) {
+	newTestRepo(t)
+	newer := SchemaVersion + 1
+	_, _, err := decodeState([]byte(fmt.Sprintf(`{"schema_version": %d, "branches": {}}`, newer)))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("schema version %d", newer)) {
+		t.Errorf("decodeState of a newer schema = %v, want it refused", err)
+	}
+}
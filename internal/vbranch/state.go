@@ -3,13 +3,12 @@ package vbranch
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/tesh254/stick/internal/constants"
+	"github.com/tesh254/stick/internal/stickdir"
 )
 
 var state *StickState
@@ -17,16 +16,12 @@ var state *StickState
 func InitializeState() {
 	if state == nil {
 		state = &StickState{
-			Branches:   make(map[string]*VirtualBranch),
-			WorkingDir: getCurrentDir(),
-			GitRoot:    getGitRoot(),
+			SchemaVersion: SchemaVersion,
+			Branches:      make(map[string]*VirtualBranch),
+			WorkingDir:    getCurrentDir(),
+			GitRoot:       getGitRoot(),
 		}
 	}
-
-	// Try to load existing state
-	if _, err := os.Stat(getStateFilePath()); err == nil {
-		loadState()
-	}
 }
 
 // EnsureStateInitialized ensures state is initialized before use
@@ -42,81 +37,190 @@ func GetState() *StickState {
 	return state
 }
 
+// getStateFilePath returns the state file inside the Git directory, or "" outside a repository
 func getStateFilePath() string {
-	return filepath.Join(constants.STICK_DIR, "state.json")
+	stateFile, err := stickdir.File(constants.STATE_FILE)
+	if err != nil {
+		return ""
+	}
+	return stateFile
 }
 
-func loadState() error {
-	stateFile := getStateFilePath()
-	data, err := ioutil.ReadFile(stateFile)
+func getJournalFilePath() string {
+	journalFile, err := stickdir.File(constants.JOURNAL_FILE)
 	if err != nil {
-		return err
+		return ""
+	}
+	return journalFile
+}
+
+// LockState takes the state lock for a whole load-modify-save cycle. It
+// moves files left in the legacy .stick directory into the Git directory,
+// finishes any save interrupted by a crash and reloads the state from disk,
+// so changes made by another stick process while we waited are not lost.
+// Releasing the lock anchors the blobs the command wrote.
+func LockState() (func(), error) {
+	EnsureStateInitialized()
+	if !isGitRepo() {
+		return nil, &NotGitRepoError{}
+	}
+
+	unlock, err := stickdir.Lock()
+	if err != nil {
+		return nil, err
+	}
+	// another process may have rewritten the anchor while we waited
+	anchoredCache = nil
+
+	if err := stickdir.MigrateLegacy(state.GitRoot); err != nil {
+		say("warning: could not migrate legacy stick directory: %v", err)
 	}
 
-	if err := json.Unmarshal(data, &state); err != nil {
+	if err := recoverJournal(); err != nil {
+		unlock()
+		return nil, fmt.Errorf("recovering interrupted state write: %v", err)
+	}
+
+	if hasStoredState() {
+		previous, migrated, err := loadState()
+		if err != nil {
+			unlock()
+			return nil, fmt.Errorf("loading state: %v", err)
+		}
+		if migrated {
+			if err := persistMigration(previous); err != nil {
+				unlock()
+				return nil, fmt.Errorf("saving migrated state: %v", err)
+			}
+		}
+	}
+
+	return func() {
+		if err := anchorBlobs(); err != nil {
+			say("warning: could not anchor stored contents: %v", err)
+		}
+		unlock()
+	}, nil
+}
+
+// recoverJournal completes a save that was interrupted after its journal
+// was written. A torn journal means the state file was never touched, so
+// it is simply discarded. Must be called with the state lock held.
+func recoverJournal() error {
+	journalFile := getJournalFilePath()
+	data, err := os.ReadFile(journalFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
+	if json.Valid(data) {
+		if err := stickdir.WriteFileAtomic(getStateFilePath(), data, 0644); err != nil {
+			return err
+		}
+	}
+	return os.Remove(journalFile)
+}
+
+// loadState reads the state file, upgrading it in memory if it uses an
+// older schema. The raw data is returned when an upgrade happened so the
+// caller can persist it.
+func loadState() ([]byte, bool, error) {
+	stateFile := getStateFilePath()
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	loaded, migrated, err := decodeState(data)
+	if err != nil {
+		return nil, false, err
+	}
+	state = loaded
+
+	// the recorded locations go stale when the repository moves
+	state.WorkingDir = getCurrentDir()
+	state.GitRoot = getGitRoot()
+
 	// Ensure maps are initialized
 	if state.Branches == nil {
 		state.Branches = make(map[string]*VirtualBranch)
 	}
 
-	return nil
+	return data, migrated, nil
 }
 
+// saveState persists the state crash-safely: the new content is first made
+// durable in the journal, then atomically swapped in for the state file
 func saveState() error {
 	EnsureStateInitialized()
 
 	stateFile := getStateFilePath()
-	data, err := json.MarshalIndent(state, "", "  ")
+	if stateFile == "" {
+		return &NotGitRepoError{}
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return err
+	}
+	state.SchemaVersion = SchemaVersion
+	data, err := encodeState(state, true)
 	if err != nil {
 		return err
 	}
+	journalFile := getJournalFilePath()
+	if err := stickdir.WriteFileSync(journalFile, data, 0644); err != nil {
+		return err
+	}
+	if err := stickdir.WriteFileAtomic(stateFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(journalFile)
+}
 
-	return ioutil.WriteFile(stateFile, data, 0644)
+// addFiles adds each of paths to branch with add and saves the state. Files
+// that fail are reported and skipped; the rest are still added. It returns
+// how many failed.
+func addFiles(branch *VirtualBranch, paths []string, add func(*VirtualBranch, string) error, added string) (int, error) {
+	failed := 0
+	for _, filename := range paths {
+		if err := add(branch, filename); err != nil {
+			say("error adding %s: %v", filename, err)
+			failed++
+			continue
+		}
+		say(added, filename, branch.Name)
+	}
+	branch.UpdatedAt = time.Now()
+	if err := saveState(); err != nil {
+		return failed, fmt.Errorf("saving state: %w", err)
+	}
+	emit(branchOutput(branch))
+	return failed, nil
 }
 
-func AddAll() {
+func AddAll() error {
 	branch := state.Branches[state.CurrentBranch]
-	gitStatus := getGitStatus()
-	for _, statusLine := range gitStatus {
-		if len(statusLine) > 3 {
-			status := statusLine[:2]
-			filename := strings.TrimSpace(statusLine[3:])
-			switch status[1] {
-			case 'M', 'A', '?': // Modified, added, or new
-				content, err := os.ReadFile(filename)
-				if err == nil {
-					branch.Files[filename] = string(content)
-					hunkType := "modify"
-					if status[0] == '?' || status[0] == 'A' {
-						hunkType = "add"
-					}
-					hunk := Hunk{
-						ID:        generateID(),
-						File:      filename,
-						StartLine: 1,
-						EndLine:   len(strings.Split(string(content), "\n")),
-						Content:   string(content),
-						Type:      hunkType,
-						CreatedAt: time.Now(),
-					}
-					branch.Hunks = append(branch.Hunks, hunk)
-				}
-			case 'D': // Deleted
-				branch.DeletedFiles = append(branch.DeletedFiles, filename)
-				hunk := Hunk{
-					ID:        generateID(),
-					File:      filename,
-					Type:      "remove",
-					CreatedAt: time.Now(),
-				}
-				branch.Hunks = append(branch.Hunks, hunk)
-			}
+	paths, err := changedPaths()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, filename := range paths {
+		if err := addFileToVirtualBranch(branch, filename); err != nil {
+			say("skipping %s: %v", filename, err)
+			failed++
 		}
 	}
 	branch.UpdatedAt = time.Now()
-	saveState()
-	fmt.Println("added all changes to virtual branch", branch.Name)
+	if err := saveState(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	emit(branchOutput(branch))
+	if len(paths) > 0 && failed == len(paths) {
+		return fmt.Errorf("none of the %d changed file(s) could be added", len(paths))
+	}
+	say("added all changes to virtual branch %s", branch.Name)
+	return nil
 }
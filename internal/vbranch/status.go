@@ -0,0 +1,195 @@
+package vbranch
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/tesh254/stick/internal/stickdir"
+)
+
+// StatusEntry is one path reported by git status --porcelain=v2
+type StatusEntry struct {
+	Kind      byte   // '1' changed, '2' renamed or copied, 'u' unmerged, '?' untracked, '!' ignored
+	Index     byte   // staged status (X), '.' when unchanged
+	Worktree  byte   // unstaged status (Y), '.' when unchanged
+	Submodule string // "N..." for a regular file, "S<c><m><u>" for a submodule
+	Path      string
+	OrigPath  string // source of a rename or copy
+}
+
+// IsSubmodule reports whether the entry is a submodule rather than a file
+func (e StatusEntry) IsSubmodule() bool {
+	return strings.HasPrefix(e.Submodule, "S")
+}
+
+// Code is the two-letter status of the short format, e.g. " M", "R " or "??"
+func (e StatusEntry) Code() string {
+	switch e.Kind {
+	case '?':
+		return "??"
+	case '!':
+		return "!!"
+	}
+	code := []byte{e.Index, e.Worktree}
+	for i, c := range code {
+		if c == '.' {
+			code[i] = ' '
+		}
+	}
+	return string(code)
+}
+
+// Paths lists the files the entry touches: for a rename, both the source,
+// which is gone, and the destination
+func (e StatusEntry) Paths() []string {
+	if e.OrigPath != "" && e.Index == 'R' {
+		return []string{e.OrigPath, e.Path}
+	}
+	return []string{e.Path}
+}
+
+// String renders the entry like a line of git status --short
+func (e StatusEntry) String() string {
+	if e.OrigPath != "" {
+		return fmt.Sprintf("%s %s -> %s", e.Code(), e.OrigPath, e.Path)
+	}
+	return fmt.Sprintf("%s %s", e.Code(), e.Path)
+}
+
+// parseStatus parses the NUL-separated output of git status --porcelain=v2 -z
+func parseStatus(data []byte) ([]StatusEntry, error) {
+	var entries []StatusEntry
+	records := bytes.Split(data, []byte{0})
+	for i := 0; i < len(records); i++ {
+		record := string(records[i])
+		if record == "" || record[0] == '#' {
+			continue
+		}
+
+		var entry StatusEntry
+		var fields []string
+		switch record[0] {
+		case '1':
+			// 1 XY sub mH mI mW hH hI path
+			fields = strings.SplitN(record, " ", 9)
+		case '2':
+			// 2 XY sub mH mI mW hH hI Xscore path, then the source path
+			fields = strings.SplitN(record, " ", 10)
+		case 'u':
+			// u XY sub m1 m2 m3 mW h1 h2 h3 path
+			fields = strings.SplitN(record, " ", 11)
+		case '?', '!':
+			if len(record) < 3 {
+				return nil, fmt.Errorf("malformed status entry %q", record)
+			}
+			entries = append(entries, StatusEntry{Kind: record[0], Index: record[0], Worktree: record[0], Path: record[2:]})
+			continue
+		default:
+			return nil, fmt.Errorf("unknown status entry %q", record)
+		}
+
+		if len(fields) < 4 || len(fields[1]) != 2 || (record[0] == '1' && len(fields) != 9) ||
+			(record[0] == '2' && len(fields) != 10) || (record[0] == 'u' && len(fields) != 11) {
+			return nil, fmt.Errorf("malformed status entry %q", record)
+		}
+		entry.Kind = record[0]
+		entry.Index = fields[1][0]
+		entry.Worktree = fields[1][1]
+		entry.Submodule = fields[2]
+		entry.Path = fields[len(fields)-1]
+		if entry.Kind == '2' {
+			i++
+			if i >= len(records) {
+				return nil, fmt.Errorf("status entry %q has no source path", record)
+			}
+			entry.OrigPath = string(records[i])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// getGitStatus lists every changed, unmerged and untracked path in the
+// working tree, leaving out stick's own files
+func getGitStatus() ([]StatusEntry, error) {
+	output, err := gitCommand("status", "--porcelain=v2", "-z", "--untracked-files=all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading git status: %v", err)
+	}
+	entries, err := parseStatus(output)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !stickdir.IsLegacyPath(entry.Path) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, nil
+}
+
+// getFileStatus returns the status of one path, or nil when it is unchanged
+func getFileStatus(filename string) (*StatusEntry, error) {
+	output, err := gitCommand("status", "--porcelain=v2", "-z", "--untracked-files=all", "--", ":(literal)"+filename).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading git status: %v", err)
+	}
+	entries, err := parseStatus(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		for _, path := range entry.Paths() {
+			if path == filename {
+				return &entry, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// changedPaths lists the paths of the working tree's changes, skipping
+// submodules, whose contents stick does not track
+func changedPaths() ([]string, error) {
+	entries, err := getGitStatus()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsSubmodule() || entry.Kind == '!' {
+			continue
+		}
+		paths = append(paths, entry.Paths()...)
+	}
+	return paths, nil
+}
+
+// expandPaths replaces each of paths that is a directory with the changed
+// paths under it. A path nothing in changed matches is kept as given, so
+// adding it reports why it cannot be added.
+func expandPaths(paths, changed []string) []string {
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		var under []string
+		for _, filename := range changed {
+			if matchesPaths(filename, []string{path}) {
+				under = append(under, filename)
+			}
+		}
+		if len(under) == 0 {
+			under = []string{path}
+		}
+		for _, filename := range under {
+			if !seen[filename] {
+				seen[filename] = true
+				expanded = append(expanded, filename)
+			}
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,118 @@
+package vbranch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// statusOutput joins records the way git status --porcelain=v2 -z does
+func statusOutput(records ...string) []byte {
+	return []byte(strings.Join(records, "\x00") + "\x00")
+}
+
+func TestParseStatus(t *testing.T) {
+	const hashes = "100644 100644 100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	tests := []struct {
+		name string
+		data []byte
+		want []StatusEntry
+	}{
+		{
+			name: "empty",
+			data: nil,
+			want: nil,
+		},
+		{
+			name: "headers are skipped",
+			data: statusOutput("# branch.oid abc", "# branch.head main"),
+			want: nil,
+		},
+		{
+			name: "changed",
+			data: statusOutput("1 .M N... " + hashes + " a.txt"),
+			want: []StatusEntry{{Kind: '1', Index: '.', Worktree: 'M', Submodule: "N...", Path: "a.txt"}},
+		},
+		{
+			name: "path with spaces and non-ASCII characters",
+			data: statusOutput("1 M. N... " + hashes + " dir/my file ü.txt"),
+			want: []StatusEntry{{Kind: '1', Index: 'M', Worktree: '.', Submodule: "N...", Path: "dir/my file ü.txt"}},
+		},
+		{
+			name: "submodule",
+			data: statusOutput("1 .M SC.. 160000 160000 160000 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 lib"),
+			want: []StatusEntry{{Kind: '1', Index: '.', Worktree: 'M', Submodule: "SC..", Path: "lib"}},
+		},
+		{
+			name: "rename followed by its source",
+			data: statusOutput("2 R. N... "+hashes+" R100 new name.txt", "old name.txt", "? after.txt"),
+			want: []StatusEntry{
+				{Kind: '2', Index: 'R', Worktree: '.', Submodule: "N...", Path: "new name.txt", OrigPath: "old name.txt"},
+				{Kind: '?', Index: '?', Worktree: '?', Path: "after.txt"},
+			},
+		},
+		{
+			name: "unmerged",
+			data: statusOutput("u UU N... 100644 100644 100644 100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 c.txt"),
+			want: []StatusEntry{{Kind: 'u', Index: 'U', Worktree: 'U', Submodule: "N...", Path: "c.txt"}},
+		},
+		{
+			name: "untracked and ignored",
+			data: statusOutput("? new file.txt", "! build/out"),
+			want: []StatusEntry{
+				{Kind: '?', Index: '?', Worktree: '?', Path: "new file.txt"},
+				{Kind: '!', Index: '!', Worktree: '!', Path: "build/out"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStatus(tt.data)
+			if err != nil {
+				t.Fatalf("parseStatus: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseStatus = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStatusMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"too few fields":         statusOutput("1 .M N... a.txt"),
+		"short status letters":   statusOutput("1 M N... 100644 100644 100644 e69de29 e69de29 a.txt"),
+		"rename without source":  []byte("2 R. N... 100644 100644 100644 e69de29 e69de29 R100 new.txt"),
+		"untracked without path": statusOutput("?"),
+		"unknown kind":           statusOutput("x something"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if entries, err := parseStatus(data); err == nil {
+				t.Errorf("parseStatus = %+v, want an error", entries)
+			}
+		})
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	changed := []string{"a.txt", "sub/b.txt", "sub/deep/c.txt", "subway.txt"}
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{"file", []string{"a.txt"}, []string{"a.txt"}},
+		{"directory", []string{"sub"}, []string{"sub/b.txt", "sub/deep/c.txt"}},
+		{"directory with trailing slash", []string{"sub/deep/"}, []string{"sub/deep/c.txt"}},
+		{"overlapping arguments", []string{"sub/deep", "sub"}, []string{"sub/deep/c.txt", "sub/b.txt"}},
+		{"unchanged path is kept", []string{"missing"}, []string{"missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandPaths(tt.paths, changed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandPaths(%q) = %q, want %q", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
@@ -6,13 +6,20 @@ import "time"
 type VirtualBranch struct {
 	Name         string            `json:"name"`
 	ID           string            `json:"id"`
-	Files        map[string]string `json:"files"`         // filename -> content for added/modified files
+	Files        map[string]string `json:"files"`         // filename -> blob of the lane's version of added/modified files
 	DeletedFiles []string          `json:"deleted_files"` // list of deleted files
+	BaseCommit   string            `json:"base_commit"`   // HEAD commit when hunks were last recorded
+	BaseBlobs    map[string]string `json:"base_blobs"`    // filename -> HEAD blob the hunks were recorded against ("" if new)
 	Hunks        []Hunk            `json:"hunks"`         // individual change hunks
 	CreatedAt    time.Time         `json:"created_at"`
 	UpdatedAt    time.Time         `json:"updated_at"`
 	Description  string            `json:"description"`
 	Active       bool              `json:"active"`
+	GitBranch    string            `json:"git_branch,omitempty"`    // Git branch backing this lane, if any
+	BaseRef      string            `json:"base_ref,omitempty"`      // remote branch the lane was created from, e.g. "origin/main"
+	PushedCommit string            `json:"pushed_commit,omitempty"` // commit created by the last push
+	PushedBase   string            `json:"pushed_base,omitempty"`   // commit the last push applied the hunks to
+	PushedAt     time.Time         `json:"pushed_at"`
 }
 
 // Hunk represents an individual change that can be moved between branches
@@ -21,17 +28,40 @@ type Hunk struct {
 	File      string    `json:"file"`       // Path to the file this hunk affects
 	StartLine int       `json:"start_line"` // Starting line number in the file
 	EndLine   int       `json:"end_line"`   // Ending line number in the file
-	Content   string    `json:"content"`    // The actual content of the change
-	Type      string    `json:"type"`       // "add", "remove", "modify"
-	Context   string    `json:"context"`    // Surrounding lines for context
+	OldStart  int       `json:"old_start"`  // Starting line in the HEAD version (unified diff numbering)
+	OldLines  int       `json:"old_lines"`  // Number of HEAD lines covered by the hunk
+	NewStart  int       `json:"new_start"`  // Starting line in the working tree version (unified diff numbering)
+	NewLines  int       `json:"new_lines"`  // Number of working tree lines covered by the hunk
+	Content   string    `json:"-"`          // Unified diff body of the change (" ", "-", "+" prefixed lines), stored as ContentBlob
+	Type      string    `json:"type"`       // "add", "remove", "modify", "rename", "copy", "mode"
+	Context   string    `json:"-"`          // Surrounding lines for context, derived from Content
 	CreatedAt time.Time `json:"created_at"` // When this hunk was created
+
+	Conflicted   bool   `json:"conflicted,omitempty"`    // Set when a rebase could not carry the hunk onto the new base
+	ConflictBase string `json:"conflict_base,omitempty"` // Blob the conflicted hunk was recorded against
+	OldFile      string `json:"old_file,omitempty"`      // Source of a rename or copy; the hunk then holds the whole file
+	Binary       bool   `json:"binary,omitempty"`        // Set for binary changes, which are stored as blobs rather than Content
+	OldBlob      string `json:"old_blob,omitempty"`      // Blob a binary hunk replaces, "" for a new file
+	NewBlob      string `json:"new_blob,omitempty"`      // Blob a binary hunk writes, "" for a removal
+	ContentBlob  string `json:"content_blob,omitempty"`  // Blob holding Content, filled in when the state is saved
+	OldMode      string `json:"old_mode,omitempty"`      // Mode before a "mode" hunk, or of the file a removal deletes
+	NewMode      string `json:"new_mode,omitempty"`      // Mode after a "mode" hunk, or of the file an addition creates
 }
 
 // StickState manages the overall state of virtual branches
 type StickState struct {
+	SchemaVersion int                       `json:"schema_version"`
 	Branches      map[string]*VirtualBranch `json:"branches"`
 	CurrentBranch string                    `json:"current_branch"`
 	WorkingDir    string                    `json:"working_dir"`
 	GitRoot       string                    `json:"git_root"`
 	LastSync      time.Time                 `json:"last_sync"`
 }
+
+// HunkConflict describes a hunk that could not be applied cleanly
+type HunkConflict struct {
+	HunkID    string `json:"hunk_id"`
+	File      string `json:"file"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+}
@@ -0,0 +1,426 @@
+package vbranch
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea/v2"
+	"github.com/charmbracelet/lipgloss/v2"
+)
+
+var (
+	uiTitleStyle    = lipgloss.NewStyle().Bold(true)
+	uiLaneStyle     = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("8")).Padding(0, 1)
+	uiFocusStyle    = uiLaneStyle.BorderForeground(lipgloss.Color("6"))
+	uiSelectedStyle = lipgloss.NewStyle().Reverse(true)
+	uiMutedStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	uiConflictStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+)
+
+// uiMinLaneWidth is the narrowest a lane column gets before lanes scroll
+const uiMinLaneWidth = 30
+
+const uiHelp = "←/→ lane  ↑/↓ hunk  H/L move hunk  enter diff  a apply/unapply  c make current  p push  q quit"
+
+// uiModel is the state of the stick ui screen
+type uiModel struct {
+	lanes   []*VirtualBranch
+	lane    int         // focused lane
+	rows    map[int]int // selected hunk row per lane
+	preview bool        // show the selected hunk's diff
+	confirm bool        // waiting for y/n before pushing the focused lane
+	pushing bool        // a push is running with the terminal handed to it
+	message string
+	width   int
+	height  int
+}
+
+// laneHunks returns the indexes of the branch's hunks in display order:
+// by file, then by position in the file
+func laneHunks(branch *VirtualBranch) []int {
+	order := make([]int, len(branch.Hunks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ha, hb := branch.Hunks[order[a]], branch.Hunks[order[b]]
+		if ha.File != hb.File {
+			return ha.File < hb.File
+		}
+		return ha.OldStart < hb.OldStart
+	})
+	return order
+}
+
+// selected returns the focused lane and the index of its selected hunk, or -1
+func (m *uiModel) selected() (*VirtualBranch, int) {
+	if len(m.lanes) == 0 {
+		return nil, -1
+	}
+	branch := m.lanes[m.lane]
+	order := laneHunks(branch)
+	if len(order) == 0 {
+		return branch, -1
+	}
+	row := min(m.rows[m.lane], len(order)-1)
+	m.rows[m.lane] = row
+	return branch, order[row]
+}
+
+func (m *uiModel) Init() tea.Cmd {
+	return nil
+}
+
+// pushDoneMsg reports that the stick push run for a lane has exited
+type pushDoneMsg struct {
+	branch string
+	err    error
+}
+
+func (m *uiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case pushDoneMsg:
+		m.pushing = false
+		m.message = fmt.Sprintf("pushed %s", msg.branch)
+		if msg.err != nil {
+			m.message = fmt.Sprintf("error pushing %s: %v", msg.branch, msg.err)
+		}
+		// the push saved its own changes to the state
+		m.act("", func() {})
+	case tea.KeyPressMsg:
+		if m.pushing {
+			return m, nil
+		}
+		if m.confirm {
+			m.confirm = false
+			if msg.String() == "y" {
+				return m, m.push()
+			}
+			m.message = "push cancelled"
+			return m, nil
+		}
+
+		m.message = ""
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return m, tea.Quit
+		case "left", "h":
+			m.lane = max(m.lane-1, 0)
+		case "right", "l":
+			m.lane = min(m.lane+1, len(m.lanes)-1)
+		case "up", "k":
+			m.rows[m.lane] = max(m.rows[m.lane]-1, 0)
+		case "down", "j":
+			if branch, _ := m.selected(); branch != nil {
+				m.rows[m.lane] = min(m.rows[m.lane]+1, max(len(branch.Hunks)-1, 0))
+			}
+		case "shift+left", "H":
+			m.act("ui move", func() { m.move(-1) })
+		case "shift+right", "L":
+			m.act("ui move", func() { m.move(1) })
+		case "enter", "d":
+			m.preview = !m.preview
+		case "a":
+			command := "ui apply"
+			if branch, _ := m.selected(); branch != nil && branch.Active {
+				command = "ui unapply"
+			}
+			m.act(command, m.toggleApplied)
+		case "c":
+			m.act("ui switch", func() {
+				if branch, _ := m.selected(); branch != nil {
+					state.CurrentBranch = branch.ID
+					m.save(fmt.Sprintf("%s is now the current branch", branch.Name))
+				}
+			})
+		case "p":
+			if branch, _ := m.selected(); branch != nil {
+				m.confirm = true
+				m.message = fmt.Sprintf("push %s? (y/n)", branch.Name)
+			}
+		}
+	}
+	return m, nil
+}
+
+// act runs one change under the state lock, recording it in the operation
+// log like any other command. The lock is only held for the change, so
+// other stick commands can run while the screen is open; the state is
+// reloaded first so their changes are kept, and the lanes are redrawn
+// from it. An empty command only reloads.
+func (m *uiModel) act(command string, change func()) {
+	unlock, err := LockState()
+	if err != nil {
+		m.message = fmt.Sprintf("error: %v", err)
+		return
+	}
+	defer unlock()
+	m.reload()
+	if command == "" {
+		return
+	}
+
+	op, err := BeginOperation(command)
+	if err != nil {
+		m.message = fmt.Sprintf("error: %v", err)
+		return
+	}
+	change()
+	if err := op.Finish(); err != nil {
+		m.message = fmt.Sprintf("could not record operation: %v", err)
+	}
+	m.reload()
+}
+
+// reload takes the lanes from the current state, keeping the focused lane
+func (m *uiModel) reload() {
+	focused := ""
+	if len(m.lanes) > 0 {
+		focused = m.lanes[m.lane].ID
+	}
+	m.lanes = sortedBranches()
+	m.lane = min(m.lane, max(len(m.lanes)-1, 0))
+	for i, branch := range m.lanes {
+		if branch.ID == focused {
+			m.lane = i
+		}
+	}
+}
+
+// save persists the state and reports done, or the error
+func (m *uiModel) save(done string) {
+	if err := saveState(); err != nil {
+		m.message = fmt.Sprintf("error saving state: %v", err)
+		return
+	}
+	m.message = done
+}
+
+// move hands the selected hunk to the lane step places away and follows it there
+func (m *uiModel) move(step int) {
+	source, index := m.selected()
+	target := m.lane + step
+	if index < 0 || target < 0 || target >= len(m.lanes) {
+		return
+	}
+	id := source.Hunks[index].ID
+	if err := moveHunk(source, index, m.lanes[target]); err != nil {
+		m.message = fmt.Sprintf("error: %v", err)
+		return
+	}
+
+	m.lane = target
+	for row, i := range laneHunks(m.lanes[target]) {
+		if m.lanes[target].Hunks[i].ID == id {
+			m.rows[target] = row
+		}
+	}
+	m.save(fmt.Sprintf("moved hunk %s to %s", shortHunkID(id), m.lanes[target].Name))
+}
+
+// toggleApplied applies the focused lane to the working tree, or takes it out
+func (m *uiModel) toggleApplied() {
+	branch, _ := m.selected()
+	if branch == nil {
+		return
+	}
+	verb := "applied"
+	apply := applyVirtualBranch
+	if branch.Active {
+		verb = "unapplied"
+		apply = unapplyVirtualBranch
+	}
+	conflicts, err := apply(branch)
+	if err != nil {
+		m.message = fmt.Sprintf("error: %v", err)
+		return
+	}
+	done := fmt.Sprintf("%s %s", verb, branch.Name)
+	if len(conflicts) > 0 {
+		done += fmt.Sprintf(" with %d conflicting hunk(s)", len(conflicts))
+	}
+	m.save(done)
+}
+
+// push runs stick push for the focused lane with the terminal handed over
+// to it, so the event loop keeps running and git can ask for credentials
+// outside the full-screen view
+func (m *uiModel) push() tea.Cmd {
+	branch, _ := m.selected()
+	exe, err := os.Executable()
+	if err != nil {
+		m.message = fmt.Sprintf("error pushing %s: %v", branch.Name, err)
+		return nil
+	}
+	cmd := exec.Command(exe, "push", branch.Name)
+	cmd.Dir = state.GitRoot
+	m.pushing = true
+	m.message = fmt.Sprintf("pushing %s...", branch.Name)
+	name := branch.Name
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return pushDoneMsg{branch: name, err: err}
+	})
+}
+
+// renderLane draws one lane column, keeping the selected hunk in view
+func (m *uiModel) renderLane(i, width, height int) string {
+	branch := m.lanes[i]
+	title := branch.Name
+	if branch.ID == state.CurrentBranch {
+		title += " *"
+	}
+	status := "unapplied"
+	if branch.Active {
+		status = "applied"
+	}
+
+	var lines []string
+	selectedLine := 0
+	file := ""
+	for row, index := range laneHunks(branch) {
+		hunk := branch.Hunks[index]
+		if hunk.File != file {
+			file = hunk.File
+			lines = append(lines, uiTitleStyle.Render(truncate(file, width)))
+		}
+		label := fmt.Sprintf(" %s -%d,%d +%d,%d", shortHunkID(hunk.ID), hunk.OldStart, hunk.OldLines, hunk.NewStart, hunk.NewLines)
+		switch {
+		case hunk.isRename():
+			label = fmt.Sprintf(" %s %s from %s", shortHunkID(hunk.ID), hunk.Type, hunk.OldFile)
+		case hunk.Binary:
+			label = fmt.Sprintf(" %s binary", shortHunkID(hunk.ID))
+		case hunk.isMode():
+			label = fmt.Sprintf(" %s mode %s", shortHunkID(hunk.ID), hunk.NewMode)
+		}
+		label = truncate(label, width)
+		switch {
+		case i == m.lane && row == m.rows[i]:
+			selectedLine = len(lines)
+			label = uiSelectedStyle.Render(label)
+		case hunk.Conflicted:
+			label = uiConflictStyle.Render(label + " !")
+		}
+		lines = append(lines, label)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, uiMutedStyle.Render("no hunks"))
+	}
+
+	body := max(height-2, 1)
+	start := 0
+	if len(lines) > body {
+		start = min(max(selectedLine-body/2, 0), len(lines)-body)
+		lines = lines[start : start+body]
+	}
+
+	header := uiTitleStyle.Render(truncate(title, width)) + "\n" + uiMutedStyle.Render(fmt.Sprintf("%s, %d hunks", status, len(branch.Hunks)))
+	style := uiLaneStyle
+	if i == m.lane {
+		style = uiFocusStyle
+	}
+	return style.Width(width + 4).Render(header + "\n" + strings.Join(lines, "\n"))
+}
+
+// renderPreview draws the selected hunk as a diff
+func (m *uiModel) renderPreview(height int) string {
+	branch, index := m.selected()
+	if index < 0 {
+		return uiMutedStyle.Render("no hunk selected")
+	}
+	hunk := branch.Hunks[index]
+	if hunk.Binary {
+		return diffFileStyle.Render(hunk.File) + "\n" + binarySummary(hunk)
+	}
+	if hunk.isMode() {
+		return diffFileStyle.Render(hunk.File) + "\n" + modeSummary(hunk.OldMode, hunk.NewMode)
+	}
+	p, err := hunk.patch()
+	if err != nil {
+		return err.Error()
+	}
+	text := diffFileStyle.Render(hunk.File) + "\n" + diffHunkStyle.Render(p.Header()) + "\n" + formatHunkBody(hunk.Content, false)
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) > height {
+		lines = append(lines[:height-1], uiMutedStyle.Render("…"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *uiModel) View() string {
+	if m.width == 0 {
+		return ""
+	}
+	if len(m.lanes) == 0 {
+		return "no virtual branches; create one with 'stick branch create'\n\n" + uiMutedStyle.Render("q quit")
+	}
+
+	// lanes share the width; when they do not fit, scroll so the focused one shows
+	visible := max(min(len(m.lanes), m.width/uiMinLaneWidth), 1)
+	first := min(max(m.lane-visible/2, 0), len(m.lanes)-visible)
+	width := max(m.width/visible-4, 8)
+
+	laneHeight := m.height - 3
+	previewHeight := 0
+	if m.preview {
+		previewHeight = m.height / 2
+		laneHeight -= previewHeight
+	}
+
+	var columns []string
+	for i := first; i < first+visible; i++ {
+		columns = append(columns, m.renderLane(i, width, laneHeight-2))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(lipgloss.JoinHorizontal(lipgloss.Top, columns...))
+	sb.WriteString("\n")
+	if m.preview {
+		sb.WriteString(m.renderPreview(previewHeight))
+		sb.WriteString("\n")
+	}
+	if m.message != "" {
+		sb.WriteString(m.message + "\n")
+	}
+	sb.WriteString(uiMutedStyle.Render(truncate(uiHelp, m.width)))
+	return sb.String()
+}
+
+// truncate cuts s to at most width runes
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 1 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// RunUI opens the full-screen interface for arranging hunks across lanes
+func RunUI() error {
+	if Structured() {
+		return fmt.Errorf("stick ui is interactive and cannot print --json or --format output")
+	}
+	unlock, err := LockState()
+	if err != nil {
+		return err
+	}
+	model := &uiModel{lanes: sortedBranches(), rows: make(map[int]int)}
+	for i, branch := range model.lanes {
+		if branch.ID == state.CurrentBranch {
+			model.lane = i
+		}
+	}
+	unlock()
+
+	if _, err := tea.NewProgram(model, tea.WithAltScreen()).Run(); err != nil {
+		return fmt.Errorf("running ui: %w", err)
+	}
+	return nil
+}
@@ -175,34 +175,6 @@ func GetDetailedVersion() string {
 	return strings.Join(parts, "\n")
 }
 
-// GetJSONVersion returns version info in JSON format
-func GetJSONVersion() string {
-	info := GetBuildInfo()
-
-	return fmt.Sprintf(`{
-  "version": "%s",
-  "git_commit": "%s",
-  "git_branch": "%s", 
-  "git_tag": "%s",
-  "build_date": "%s",
-  "go_version": "%s",
-  "platform": "%s",
-  "compiler": "%s",
-  "is_modified": %t,
-  "module_path": "%s"
-}`,
-		info.Version,
-		info.GitCommit,
-		info.GitBranch,
-		info.GitTag,
-		info.BuildDate,
-		info.GoVersion,
-		info.Platform,
-		info.Compiler,
-		info.IsModified,
-		info.ModulePath)
-}
-
 // IsRelease checks if this is a release build
 func IsRelease() bool {
 	info := GetBuildInfo()